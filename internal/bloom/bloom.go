@@ -0,0 +1,163 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	DefaultFalsePositiveRate = 0.01
+
+	// MinFalsePositiveRate is the lowest false positive rate of filters,
+	// taking MaxHashes hashes.
+	MinFalsePositiveRate = 1.0 / (1 << MaxHashes)
+
+	// MaxHashes bounds the number of hashes of decoded filters.
+	MaxHashes = 32
+)
+
+var ErrInvalidFilter = errors.New("bloom: invalid encoded filter")
+
+// Filter is a Bloom filter: a set which may report false positives, at a
+// rate chosen at creation time, but never false negatives.
+type Filter struct {
+	bits     []uint64
+	hashes   uint32
+	capacity uint64
+	count    uint64
+}
+
+// New returns a filter sized to hold capacity elements with the given false
+// positive rate.
+func New(capacity int, fpRate float64) *Filter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultFalsePositiveRate
+	}
+
+	if fpRate < MinFalsePositiveRate {
+		fpRate = MinFalsePositiveRate
+	}
+
+	n := float64(capacity)
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+
+	return &Filter{
+		bits:     make([]uint64, int(math.Ceil(m/64))),
+		hashes:   uint32(k),
+		capacity: uint64(capacity),
+	}
+}
+
+func (f *Filter) Add(s string) {
+	h1, h2 := hash(s)
+	m := uint64(len(f.bits)) * 64
+
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+
+	f.count++
+}
+
+// Test reports whether s was probably added to the filter.
+func (f *Filter) Test(s string) bool {
+	h1, h2 := hash(s)
+	m := uint64(len(f.bits)) * 64
+
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Count returns how many elements were added.
+func (f *Filter) Count() int { return int(f.count) }
+
+// Capacity returns the number of elements the filter was sized for; past it
+// the false positive rate grows beyond the requested one.
+func (f *Filter) Capacity() int { return int(f.capacity) }
+
+// MarshalBinary encodes the filter as: hashes (uint32), capacity (uint64),
+// count (uint64) and the bit set, all little endian.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 20, 20+len(f.bits)*8)
+	binary.LittleEndian.PutUint32(b[0:], f.hashes)
+	binary.LittleEndian.PutUint64(b[4:], f.capacity)
+	binary.LittleEndian.PutUint64(b[12:], f.count)
+
+	for _, word := range f.bits {
+		b = binary.LittleEndian.AppendUint64(b, word)
+	}
+
+	return b, nil
+}
+
+func (f *Filter) UnmarshalBinary(b []byte) error {
+	if len(b) < 28 || (len(b)-20)%8 != 0 {
+		return ErrInvalidFilter
+	}
+
+	hashes := binary.LittleEndian.Uint32(b[0:])
+	if hashes == 0 || hashes > MaxHashes {
+		return ErrInvalidFilter
+	}
+
+	capacity := binary.LittleEndian.Uint64(b[4:])
+	words := (len(b) - 20) / 8
+	if !validSize(words, hashes, capacity) {
+		return ErrInvalidFilter
+	}
+
+	f.hashes = hashes
+	f.capacity = capacity
+	f.count = binary.LittleEndian.Uint64(b[12:])
+	f.bits = make([]uint64, words)
+
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(b[20+i*8:])
+	}
+
+	return nil
+}
+
+// validSize reports whether a bit set of words fits the given number of
+// hashes and capacity, as sized by New: the number of hashes is the number of
+// bits per element times ln 2, rounded.
+func validSize(words int, hashes uint32, capacity uint64) bool {
+	if capacity == 0 {
+		return false
+	}
+
+	n := float64(capacity)
+	lo, hi := (float64(hashes)-0.5)*n/math.Ln2, (float64(hashes)+0.5)*n/math.Ln2
+	if hashes == 1 { // also when rounded down to none
+		lo = 0
+	}
+
+	// the number of bits is rounded up to whole words
+	return float64(words)*64 >= lo-1 && float64(words-1)*64 <= hi+1
+}
+
+// hash returns the two hashes combined (Kirsch-Mitzenmacher) to derive the
+// positions of an element.
+func hash(s string) (uint64, uint64) {
+	a := fnv.New64a()
+	a.Write([]byte(s))
+
+	b := fnv.New64()
+	b.Write([]byte(s))
+
+	return a.Sum64(), b.Sum64() | 1 // odd, so positions do not repeat early
+}
@@ -0,0 +1,84 @@
+package bloom_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(10000, 0.01)
+
+	for i := 0; i < 10000; i++ {
+		f.Add(fmt.Sprintf("key-%d", i))
+	}
+
+	for i := 0; i < 10000; i++ {
+		assert.True(t, f.Test(fmt.Sprintf("key-%d", i)))
+	}
+
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if f.Test(fmt.Sprintf("other-%d", i)) {
+			fp++
+		}
+	}
+
+	assert.Less(t, fp, 200) // 1% expected, allowing some slack
+	assert.Equal(t, 10000, f.Count())
+	assert.Equal(t, 10000, f.Capacity())
+}
+
+func TestFilter_MarshalBinary(t *testing.T) {
+	f := New(100, 0.001)
+	f.Add("a")
+	f.Add("b")
+
+	b, err := f.MarshalBinary()
+	require.NoError(t, err)
+
+	var g Filter
+	require.NoError(t, g.UnmarshalBinary(b))
+
+	assert.True(t, g.Test("a"))
+	assert.True(t, g.Test("b"))
+	assert.False(t, g.Test("c"))
+	assert.Equal(t, 2, g.Count())
+	assert.Equal(t, 100, g.Capacity())
+
+	assert.ErrorIs(t, g.UnmarshalBinary([]byte{1, 2, 3}), ErrInvalidFilter)
+
+	for _, tt := range []struct {
+		capacity int
+		fpRate   float64
+	}{
+		{1, 0.5}, {1, 0.01}, {7, 0.9}, {100, 0.001}, {1000, 0.01}, {12345, 1e-9}, {100000, 0.05}, {10, 1e-15},
+	} {
+		b, err := New(tt.capacity, tt.fpRate).MarshalBinary()
+		require.NoError(t, err)
+		assert.NoError(t, g.UnmarshalBinary(b), tt)
+	}
+
+	corrupt := func(modify func(b []byte) []byte) []byte {
+		b, err := New(1000, 0.01).MarshalBinary()
+		require.NoError(t, err)
+		return modify(b)
+	}
+
+	for name, b := range map[string][]byte{
+		"no hashes":        corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint32(b, 0); return b }),
+		"too many hashes":  corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint32(b, MaxHashes+1); return b }),
+		"no capacity":      corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint64(b[4:], 0); return b }),
+		"larger capacity":  corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint64(b[4:], 1000000); return b }),
+		"smaller capacity": corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint64(b[4:], 10); return b }),
+		"more bits":        corrupt(func(b []byte) []byte { return append(b, make([]byte, 8*1000)...) }),
+		"fewer bits":       corrupt(func(b []byte) []byte { return b[:len(b)-8*50] }),
+	} {
+		assert.ErrorIs(t, g.UnmarshalBinary(b), ErrInvalidFilter, name)
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Namespace prefixes the names of every metric. Metrics are registered on the
+// default registry.
+const Namespace = "nginx_p2p_cache"
+
+var (
+	FilesystemEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "filesystem_events_total",
+		Help:      "Filesystem (fsnotify) events seen on the cache directories, by operation.",
+	}, []string{"op"})
+
+	ReplicatedEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "replicated_entries_total",
+		Help:      "Cache entries pulled from peers, by zone.",
+	}, []string{"zone"})
+
+	ReplicatedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "replicated_bytes_total",
+		Help:      "Bytes of the cache entries pulled from peers, by zone.",
+	}, []string{"zone"})
+
+	ReplicationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "replication_failures_total",
+		Help:      "Failures comparing caches with peers or pulling entries from them, by zone and reason.",
+	}, []string{"zone", "reason"})
+
+	FallbackRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "fallback_requests_total",
+		Help:      "Cache misses served through the fallback server, by zone and result (hit when a peer had the entry).",
+	}, []string{"zone", "result"})
+
+	serverHandling = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "grpc_server_handling_seconds",
+		Help:      "Time taken to handle gRPC calls (until the end of the stream, for streaming ones), by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	clientHandling = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "grpc_client_handling_seconds",
+		Help:      "Time taken by gRPC calls to peers (until the stream is established, for streaming ones), by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
@@ -0,0 +1,274 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Certificates are the certificate, private key and certificate authorities
+// (CA) of this node, used on both sides of the mutual TLS between peers. They
+// are reloaded from their files whenever these change, so rotated
+// certificates take effect on the next connections.
+//
+// Peers must present a certificate signed by one of the CAs and, if any
+// allowlist is set, having a SAN or SPIFFE ID in it. Host names are not
+// verified otherwise, as peers are usually reached by IP address.
+type Certificates struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is a PEM bundle with the CAs peer certificates are verified by.
+	CAFile string
+	// AllowedSANs are the DNS names, IP addresses and URIs peer certificates
+	// may have; "*." at the start of a DNS name matches a single label.
+	AllowedSANs []string
+	// AllowedSPIFFEIDs are the SPIFFE IDs peer certificates may have; an ID
+	// without path (e.g. "spiffe://example.org") matches the whole trust
+	// domain.
+	AllowedSPIFFEIDs []string
+	Logger           *zap.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// Load reads the certificates for the first time.
+func (c *Certificates) Load() error {
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+
+	if c.CertFile == "" || c.KeyFile == "" || c.CAFile == "" {
+		return errors.New("certificate, key and CA files are required")
+	}
+
+	for _, id := range c.AllowedSPIFFEIDs {
+		if u, err := url.Parse(id); err != nil || u.Scheme != "spiffe" || u.Host == "" {
+			return fmt.Errorf("invalid SPIFFE ID %q", id)
+		}
+	}
+
+	return c.load()
+}
+
+// Watch reloads the certificates whenever their files change, until ctx is
+// canceled. Reload failures are logged, the previous certificates staying in
+// use.
+func (c *Certificates) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// NOTE: watching the parent directories since Kubernetes Secret volumes
+	// (and most tools) replace the files instead of writing to them.
+	dirs := make(map[string]struct{})
+	for _, name := range []string{c.CertFile, c.KeyFile, c.CAFile} {
+		dirs[filepath.Dir(name)] = struct{}{}
+	}
+
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case evt, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("events channel is closed")
+			}
+
+			if evt.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if err := c.load(); err != nil {
+				c.Logger.Error("Failed to reload TLS certificates", zap.Error(err))
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("errors channel is closed")
+			}
+
+			c.Logger.Error("Failed to watch TLS certificates", zap.Error(err))
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *Certificates) load() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	ca, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no CA certificates found in %s", c.CAFile)
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	c.cert.Store(&cert)
+	c.pool.Store(pool)
+
+	c.Logger.Info("TLS certificates loaded", zap.String("subject", cert.Leaf.Subject.String()), zap.Time("not_after", cert.Leaf.NotAfter))
+
+	return nil
+}
+
+// ServerConfig returns the TLS configuration of the gRPC server, requiring
+// client certificates.
+func (c *Certificates) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert, // verified by verifyPeer, against the current CAs
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		},
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return c.verifyPeer(raw, x509.ExtKeyUsageClientAuth)
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration of the connections to peers.
+func (c *Certificates) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // verified by verifyPeer, against the current CAs
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		},
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return c.verifyPeer(raw, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// verifyPeer verifies the certificate chain presented by a peer against the
+// CAs and the allowlists.
+func (c *Certificates) verifyPeer(raw [][]byte, usage x509.ExtKeyUsage) error {
+	if len(raw) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(raw))
+	for i := range raw {
+		cert, err := x509.ParseCertificate(raw[i])
+		if err != nil {
+			return err
+		}
+
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := certs[0]
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.pool.Load(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !c.allowed(leaf) {
+		c.Logger.Warn("Rejected peer certificate", zap.String("subject", leaf.Subject.String()), zap.Strings("sans", sans(leaf)))
+		return fmt.Errorf("peer certificate %q is not allowed", leaf.Subject)
+	}
+
+	return nil
+}
+
+// allowed reports whether a peer certificate matches the allowlists; any
+// certificate does when there are none.
+func (c *Certificates) allowed(cert *x509.Certificate) bool {
+	if len(c.AllowedSANs) == 0 && len(c.AllowedSPIFFEIDs) == 0 {
+		return true
+	}
+
+	for _, san := range sans(cert) {
+		for _, allowed := range c.AllowedSANs {
+			if matchSAN(allowed, san) {
+				return true
+			}
+		}
+	}
+
+	for _, u := range cert.URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+
+		for _, allowed := range c.AllowedSPIFFEIDs {
+			if matchSPIFFEID(allowed, u) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sans returns the DNS names, IP addresses and URIs of a certificate.
+func sans(cert *x509.Certificate) (names []string) {
+	names = append(names, cert.DNSNames...)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+
+	return
+}
+
+func matchSAN(pattern, san string) bool {
+	if rest, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, domain, found := strings.Cut(san, ".")
+		return found && label != "" && strings.EqualFold(domain, rest)
+	}
+
+	return strings.EqualFold(pattern, san)
+}
+
+func matchSPIFFEID(allowed string, id *url.URL) bool {
+	u, err := url.Parse(allowed)
+	if err != nil || !strings.EqualFold(u.Host, id.Host) {
+		return false
+	}
+
+	return u.Path == "" || u.Path == id.Path
+}
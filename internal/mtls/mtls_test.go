@@ -0,0 +1,226 @@
+package mtls_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/mtls"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &authority{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a peer certificate and its key to dir, returning their paths.
+func (a *authority) issue(t *testing.T, dir string, serial int64, dnsName, spiffeID string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{dnsName},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	if spiffeID != "" {
+		u, err := url.Parse(spiffeID)
+		require.NoError(t, err)
+		tmpl.URIs = []*url.URL{u}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func (a *authority) certificates(t *testing.T, dnsName, spiffeID string) *Certificates {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, a.pem, 0o600))
+
+	certFile, keyFile := a.issue(t, dir, 2, dnsName, spiffeID)
+
+	return &Certificates{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+}
+
+// handshake returns the errors of the client and server handshakes.
+func handshake(t *testing.T, client, server *Certificates) (error, error) {
+	t.Helper()
+
+	// NOTE: not using net.Pipe as it is unbuffered, and the server sends its
+	// alert after the client handshake is over with TLS 1.3.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer s.Close()
+
+		errc <- tls.Server(s, server.ServerConfig()).Handshake()
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	cerr := tls.Client(c, client.ClientConfig()).Handshake()
+	if cerr != nil {
+		c.Close()
+	}
+
+	return cerr, <-errc
+}
+
+func TestCertificates(t *testing.T) {
+	ca := newAuthority(t)
+
+	server := ca.certificates(t, "a.peers.local", "spiffe://example.org/ns/cache/sa/a")
+	require.NoError(t, server.Load())
+
+	client := ca.certificates(t, "b.peers.local", "spiffe://example.org/ns/cache/sa/b")
+	require.NoError(t, client.Load())
+
+	cerr, serr := handshake(t, client, server)
+	assert.NoError(t, cerr)
+	assert.NoError(t, serr)
+
+	t.Run("allowlists", func(t *testing.T) {
+		for _, tt := range []struct {
+			sans, ids []string
+			allowed   bool
+		}{
+			{sans: []string{"b.peers.local"}, allowed: true},
+			{sans: []string{"*.peers.local"}, allowed: true},
+			{sans: []string{"*.local"}},
+			{sans: []string{"10.0.0.1"}, allowed: true},
+			{ids: []string{"spiffe://example.org"}, allowed: true},
+			{ids: []string{"spiffe://example.org/ns/cache/sa/b"}, allowed: true},
+			{ids: []string{"spiffe://example.org/ns/cache/sa/a"}},
+			{sans: []string{"a.peers.local"}, ids: []string{"spiffe://other.org"}},
+		} {
+			server.AllowedSANs, server.AllowedSPIFFEIDs = tt.sans, tt.ids
+
+			_, serr := handshake(t, client, server)
+			if tt.allowed {
+				assert.NoError(t, serr, tt)
+			} else {
+				assert.ErrorContains(t, serr, "not allowed", tt)
+			}
+		}
+
+		server.AllowedSANs, server.AllowedSPIFFEIDs = nil, nil
+	})
+
+	t.Run("unknown CA", func(t *testing.T) {
+		other := newAuthority(t).certificates(t, "c.peers.local", "")
+		require.NoError(t, other.Load())
+
+		cerr, _ := handshake(t, other, server)
+		assert.ErrorContains(t, cerr, "unknown authority")
+
+		// trusting the server, yet presenting a certificate it does not trust
+		impostor := &Certificates{CertFile: other.CertFile, KeyFile: other.KeyFile, CAFile: server.CAFile}
+		require.NoError(t, impostor.Load())
+
+		_, serr := handshake(t, impostor, server)
+		assert.ErrorContains(t, serr, "unknown authority")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Error(t, (&Certificates{CertFile: server.CertFile, KeyFile: server.KeyFile}).Load())
+		assert.Error(t, (&Certificates{CertFile: server.CertFile, KeyFile: server.KeyFile, CAFile: server.CertFile + ".missing"}).Load())
+		assert.Error(t, (&Certificates{CertFile: server.CertFile, KeyFile: server.KeyFile, CAFile: server.CAFile, AllowedSPIFFEIDs: []string{"https://example.org"}}).Load())
+	})
+}
+
+func TestCertificates_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ca := newAuthority(t)
+
+	certs := ca.certificates(t, "a.peers.local", "")
+	require.NoError(t, certs.Load())
+
+	serial := func() int64 {
+		cert, err := certs.ServerConfig().GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Leaf.SerialNumber.Int64()
+	}
+
+	assert.EqualValues(t, 2, serial())
+
+	go certs.Watch(ctx)
+
+	require.Eventually(t, func() bool {
+		ca.issue(t, filepath.Dir(certs.CertFile), 3, "a.peers.local", "") // rotated
+		return serial() == 3
+	}, 5*time.Second, 100*time.Millisecond)
+}
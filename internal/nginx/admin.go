@@ -0,0 +1,256 @@
+package nginx
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+const (
+	DefaultEntriesPageSize   = 100
+	MaxEntriesPageSize       = 1000
+	DefaultMaxEntriesScanned = 10000
+)
+
+// AdminHandler serves the admin HTTP endpoints, as JSON:
+//
+//   - /peers lists the peers, with the state of their connections and when
+//     the caches were last compared;
+//   - /entries lists the cache entries of a zone (see ServeEntries);
+//   - /healthz and /readyz report whether every cache zone is synced with its
+//     directory and the warm-up is done; /readyz responds 503 while that is
+//     not the case;
+//   - /purge purges cache entries (see PurgeHandler).
+//
+// As they expose the cluster topology and the cache keys, or change the
+// cache, /peers, /entries and /purge answer loopback clients only unless
+// Token is set; /healthz and /readyz answer anyone, e.g. kubelet probes.
+type AdminHandler struct {
+	Manager *CacheManager
+	Server  crv1.CacheRepositoryServer
+	Logger  *zap.Logger
+	// Token, when set, lets clients other than loopback ones reach the
+	// restricted endpoints, presenting it as a bearer token.
+	Token string
+	// MaxEntriesScanned limits the entries looked at for each page of
+	// /entries; DefaultMaxEntriesScanned when zero.
+	MaxEntriesScanned int
+
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+type peerStatus struct {
+	ID       string     `json:"id"`
+	Address  string     `json:"address"`
+	State    string     `json:"state"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+}
+
+type entryStatus struct {
+	ID           string     `json:"id"`
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	Modification time.Time  `json:"modification"`
+	Valid        *time.Time `json:"valid,omitempty"`
+	Filename     string     `json:"filename"`
+}
+
+type entriesPage struct {
+	Entries       []entryStatus `json:"entries"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+}
+
+type zoneStatus struct {
+	Name    string `json:"name"`
+	Synced  bool   `json:"synced"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type healthStatus struct {
+	Ready  bool         `json:"ready"`
+	Zones  []zoneStatus `json:"zones"`
+	WarmUp WarmUpStatus `json:"warm_up"`
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.mux = http.NewServeMux()
+		h.mux.Handle("/peers", h.restricted(http.HandlerFunc(h.ServePeers)))
+		h.mux.Handle("/entries", h.restricted(http.HandlerFunc(h.ServeEntries)))
+		h.mux.HandleFunc("/healthz", h.serveHealth(false))
+		h.mux.HandleFunc("/readyz", h.serveHealth(true))
+		h.mux.Handle("/purge", h.restricted(&PurgeHandler{Manager: h.Manager, Server: h.Server, Logger: h.Logger}))
+	})
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// restricted serves next to loopback clients and, when Token is set, to the
+// clients presenting it as a bearer token.
+func (h *AdminHandler) restricted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if h.Token == "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServePeers lists the peers, sorted by ID.
+func (h *AdminHandler) ServePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []peerStatus{}
+
+	h.Manager.peers.Range(func(key, value any) bool {
+		pc := value.(*peerConn)
+
+		ps := peerStatus{
+			ID:      key.(string),
+			Address: pc.peer.Address(h.Manager.Port),
+			State:   strings.ToLower(pc.conn.GetState().String()),
+		}
+
+		if ns := pc.lastSync.Load(); ns > 0 {
+			t := time.Unix(0, ns).UTC()
+			ps.LastSync = &t
+		}
+
+		peers = append(peers, ps)
+		return true
+	})
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	h.writeJSON(w, http.StatusOK, peers)
+}
+
+// ServeEntries lists the cache entries of a zone in ID order, taking from the
+// query string the zone name (optional with a single zone), the ID prefix, a
+// glob pattern over the cache keys (see cr.KeyPattern), page_size and the
+// page_token returned by the previous page. As pages filtered by pattern may
+// take long to fill, they end once MaxEntriesScanned entries are looked at,
+// with fewer entries (possibly none) and a next page token.
+func (h *AdminHandler) ServeEntries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	z, ok := h.Manager.Zone(q.Get("zone"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cache zone %q", q.Get("zone")), http.StatusBadRequest)
+		return
+	}
+
+	pageSize := DefaultEntriesPageSize
+	if q.Has("page_size") {
+		n, err := strconv.Atoi(q.Get("page_size"))
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid page_size %q", q.Get("page_size")), http.StatusBadRequest)
+			return
+		}
+
+		if pageSize = n; pageSize > MaxEntriesPageSize {
+			pageSize = MaxEntriesPageSize
+		}
+	}
+
+	var match func(string) bool
+	if q.Has("pattern") {
+		m, err := cr.KeyPattern(q.Get("pattern"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		match = m
+	}
+
+	scan := h.MaxEntriesScanned
+	if scan <= 0 {
+		scan = DefaultMaxEntriesScanned
+	}
+
+	entries, next := z.Watcher.Scan(q.Get("prefix"), q.Get("page_token"), pageSize, scan, match)
+
+	page := entriesPage{Entries: make([]entryStatus, 0, len(entries)), NextPageToken: next}
+	for _, ce := range entries {
+		page.Entries = append(page.Entries, newEntryStatus(ce))
+	}
+
+	h.writeJSON(w, http.StatusOK, page)
+}
+
+func (h *AdminHandler) serveHealth(strict bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{WarmUp: h.Manager.WarmUp()}
+		status.Ready = status.WarmUp.Done
+
+		for _, z := range h.Manager.Zones {
+			entries, bytes := z.Watcher.Stats()
+			synced := z.Watcher.Synced()
+
+			status.Ready = status.Ready && synced
+			status.Zones = append(status.Zones, zoneStatus{Name: z.Name, Synced: synced, Entries: entries, Bytes: bytes})
+		}
+
+		code := http.StatusOK
+		if strict && !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+
+		h.writeJSON(w, code, status)
+	}
+}
+
+func (h *AdminHandler) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.Logger.Debug("Failed to write admin response", zap.Error(err))
+	}
+}
+
+func newEntryStatus(ce cr.CacheEntry) entryStatus {
+	es := entryStatus{
+		ID:           ce.ID,
+		Key:          ce.Key,
+		Size:         ce.Size,
+		Modification: ce.Modification.UTC(),
+		Filename:     ce.Filename,
+	}
+
+	if !ce.ValidSec.IsZero() {
+		valid := ce.ValidSec.UTC()
+		es.Valid = &valid
+	}
+
+	return es
+}
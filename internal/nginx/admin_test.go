@@ -0,0 +1,182 @@
+package nginx_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	peer := newTestPeer(t, nil)
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	for _, key := range []string{"/images/a.png", "/images/b.png", "/images/c.png", "/index.html"} {
+		writeCacheFile(t, local.Directory, key, "HTTP/1.1 200 OK\r\n\r\n", "body")
+	}
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+		Zones:      []*Zone{{Name: "static", Watcher: local}},
+		Interval:   time.Hour,
+	}
+
+	h := &AdminHandler{Manager: cm, Server: &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": local}, Peers: cm, Logger: zap.NewNop()}, Logger: zap.NewNop()}
+
+	get := func(target string, v any) int {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if v != nil {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(v))
+		}
+
+		return w.Code
+	}
+
+	// not synced until the watcher scans the directory
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz", nil))
+	assert.Equal(t, http.StatusOK, get("/healthz", nil))
+
+	go local.Watch(ctx)
+	go cm.Reconcile(ctx)
+
+	require.Eventually(t, func() bool { return get("/readyz", nil) == http.StatusOK }, 5*time.Second, 10*time.Millisecond)
+
+	var health struct {
+		Ready bool
+		Zones []struct {
+			Name    string
+			Synced  bool
+			Entries int
+		}
+	}
+	assert.Equal(t, http.StatusOK, get("/healthz", &health))
+	assert.True(t, health.Ready)
+	require.Len(t, health.Zones, 1)
+	assert.Equal(t, 4, health.Zones[0].Entries)
+
+	var peers []struct {
+		ID      string
+		Address string
+		State   string
+	}
+	require.Eventually(t, func() bool { return get("/peers", &peers) == http.StatusOK && len(peers) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, peer.ID(), peers[0].Address)
+	assert.NotEmpty(t, peers[0].State)
+
+	// filtered pages
+	list := func(pattern string) (keys []string, pages int) {
+		t.Helper()
+
+		var token string
+		for ; ; pages++ {
+			require.Less(t, pages, 10)
+
+			var page struct {
+				Entries       []struct{ ID, Key string }
+				NextPageToken string `json:"next_page_token"`
+			}
+			require.Equal(t, http.StatusOK, get("/entries?page_size=2&pattern="+pattern+"&page_token="+token, &page))
+			assert.LessOrEqual(t, len(page.Entries), 2)
+
+			for _, e := range page.Entries {
+				keys = append(keys, e.Key)
+			}
+
+			if token = page.NextPageToken; token == "" {
+				return keys, pages + 1
+			}
+		}
+	}
+
+	keys, pages := list("/images/*")
+	assert.ElementsMatch(t, []string{"/images/a.png", "/images/b.png", "/images/c.png"}, keys)
+	assert.Equal(t, 2, pages)
+
+	// looking at a single entry per page
+	h.MaxEntriesScanned = 1
+
+	keys, pages = list("/index.html")
+	assert.Equal(t, []string{"/index.html"}, keys)
+	assert.Equal(t, 4, pages)
+
+	assert.Equal(t, http.StatusBadRequest, get("/entries?zone=unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, get("/entries?pattern=[a", nil))
+
+	// listings answer loopback clients only, while health checks answer anyone
+	for _, target := range []string{"/peers", "/entries"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusForbidden, w.Code, target)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// purges answer loopback clients, and others presenting the token
+	purge := func(target, remoteAddr, token string) (code int, fanOut []any) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code == http.StatusOK {
+			var resp struct{ Peers []any }
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			fanOut = resp.Peers
+		}
+
+		return w.Code, fanOut
+	}
+
+	code, _ := purge("/purge?key=/index.html", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, fanOut := purge("/purge?key=/index.html", "127.0.0.1:1234", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, fanOut, "not sent to peers by default")
+
+	h.Token = "secret"
+
+	code, _ = purge("/purge?key=/images/a.png", "192.0.2.1:1234", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, fanOut = purge("/purge?key=/images/a.png&fan_out=true", "192.0.2.1:1234", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, fanOut, 1)
+
+	// as do listings
+	r := httptest.NewRequest(http.MethodGet, "/entries", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -1,30 +1,94 @@
 package nginx
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
-	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
 	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/ring"
 	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
 )
 
+var tracer = otel.Tracer("github.com/nettoclaudio/nginx-p2p-cache/internal/nginx")
+
 type CacheManager struct {
 	Discoverer sd.ServiceDiscoverer
-	Watcher    *cr.CacheWatcher
-	Interval   time.Duration
-	Logger     *zap.Logger
-	Port       int
+	// Zones are the cache zones shared with peers.
+	Zones    []*Zone
+	Interval time.Duration
+	Logger   *zap.Logger
+	Port     int
+
+	// MaxConcurrentFetches limits the number of entries pulled at once.
+	MaxConcurrentFetches int
+	// MaxBytesPerCycle limits how many bytes are pulled on each reconcile cycle.
+	MaxBytesPerCycle int64
+	// MinRemainingTTL skips entries expiring sooner than that, as they would
+	// be stale (or nearly) once copied.
+	MinRemainingTTL time.Duration
+
+	// Self is the address (host:port) peers use to reach this node. It places
+	// this node on the hash ring; when empty every key is considered owned.
+	// Either an IP address or a host name, as peers are told apart by their
+	// resolved addresses.
+	Self string
+	// VirtualNodes is the number of points each node takes on the hash ring.
+	VirtualNodes int
+	// DigestFalsePositiveRate is the false positive rate of the peer digests.
+	DigestFalsePositiveRate float64
+
+	// TransportCredentials secure the connections to peers; when nil, they
+	// are plaintext.
+	TransportCredentials credentials.TransportCredentials
+
+	// Resolver looks up the host names of the peers and Self, so they are
+	// resolved like discovered (e.g. through the DNS server of the
+	// discoverer); net.DefaultResolver when nil.
+	Resolver *net.Resolver
+
+	// WarmUpTimeout limits the warm-up, when the entries this node should
+	// hold are pulled from peers before reporting ready; 0 disables it.
+	WarmUpTimeout time.Duration
+	// WarmUpBytes is the byte target of the warm-up; 0 means every entry.
+	WarmUpBytes int64
+
+	self     string   // canonical address of Self
+	peers    sync.Map // *peerConn by peer ID
+	ring     atomic.Pointer[ring.Ring]
+	ringMu   sync.Mutex // serializes ring rebuilds
+	inflight sync.Map   // cache entries being fetched, by zone and ID
+	fetches  *semaphore.Weighted
+	pulls    *semaphore.Weighted // pulls started by peer watches
+	budget   atomic.Int64        // bytes still allowed to be fetched in this cycle
+	warm     warmUpState
+}
 
-	peers sync.Map // grpc connection by peer (IP)
+type peerConn struct {
+	peer     sd.Peer
+	node     string // canonical address, placing the peer on the hash ring
+	conn     *grpc.ClientConn
+	cancel   context.CancelFunc     // stops watching the peer
+	digests  map[string]*peerDigest // by zone name
+	lastSync atomic.Int64           // when the caches were last compared (Unix nanoseconds)
 }
 
 func (cm *CacheManager) Reconcile(ctx context.Context) error {
@@ -36,6 +100,39 @@ func (cm *CacheManager) Reconcile(ctx context.Context) error {
 		cm.Logger = zap.NewNop()
 	}
 
+	if len(cm.Zones) == 0 {
+		return errors.New("no cache zones to manage")
+	}
+
+	for _, z := range cm.Zones {
+		z.setDefaults()
+	}
+
+	if cm.MaxConcurrentFetches <= 0 {
+		cm.MaxConcurrentFetches = DefaultMaxConcurrentFetches
+	}
+
+	if cm.MaxBytesPerCycle <= 0 {
+		cm.MaxBytesPerCycle = DefaultMaxBytesPerCycle
+	}
+
+	if cm.DigestFalsePositiveRate <= 0 || cm.DigestFalsePositiveRate >= 1 {
+		cm.DigestFalsePositiveRate = bloom.DefaultFalsePositiveRate
+	}
+
+	if cm.VirtualNodes <= 0 {
+		cm.VirtualNodes = ring.DefaultVirtualNodes
+	}
+
+	if cm.Self != "" {
+		cm.self = cm.canonicalAddress(ctx, cm.Self)
+	}
+
+	cm.fetches = semaphore.NewWeighted(int64(cm.MaxConcurrentFetches))
+	cm.pulls = semaphore.NewWeighted(int64(cm.MaxConcurrentFetches))
+	cm.budget.Store(cm.MaxBytesPerCycle)
+	cm.updateRing()
+
 	cm.Logger.Debug("Starting cache manager")
 	defer cm.Logger.Debug("Finishing cache manager")
 
@@ -53,52 +150,135 @@ func (cm *CacheManager) Reconcile(ctx context.Context) error {
 }
 
 func (cm *CacheManager) reconcile(ctx context.Context) error {
+	cm.warmUp(ctx)
+
 	ticker := time.NewTicker(cm.Interval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
+			cm.budget.Store(cm.MaxBytesPerCycle)
+			cm.syncTombstones(ctx)
+			cm.refreshDigests(ctx)
+			cm.replicate(ctx)
 
-			cm.peers.Range(func(key, value any) bool {
-				peer := key.(string)
-				cm.Logger.Debug("Calling RPC server", zap.String("peer", peer))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
 
-				conn := value.(*grpc.ClientConn)
-				r, err := crv1.NewCacheRepositoryClient(conn).List(context.TODO(), &crv1.ListRequest{})
-				if err != nil {
-					cm.Logger.Error("failed to list cache", zap.String("peer", peer), zap.Error(err))
-					return true
-				}
+// diff retrieves the cache entries of a peer which may be missing locally.
+// It walks the peer's Merkle tree from the root, descending only into the
+// buckets whose hashes differ from the local ones, and lists the entries of
+// those buckets once they are small enough.
+func (cm *CacheManager) diff(ctx context.Context, z *Zone, conn *grpc.ClientConn) (map[string]*crv1.CacheItem, error) {
+	client := crv1.NewCacheRepositoryClient(conn)
+	items := make(map[string]*crv1.CacheItem)
 
-				cm.Logger.Info("Response", zap.Any("response", r))
+	r, err := client.Summary(ctx, &crv1.SummaryRequest{Zone: z.namespace()})
+	if err != nil {
+		return nil, err
+	}
 
-				return true
-			})
+	if err = cm.diffNode(ctx, z, client, r.Node, items); err != nil {
+		return nil, err
+	}
 
-		case <-ctx.Done():
+	return items, nil
+}
+
+// diffNode collects the differing entries below a node of the peer's tree. A
+// subtree is listed with a single prefix (and as few pages as possible) once
+// that takes no more calls than descending into its differing children.
+func (cm *CacheManager) diffNode(ctx context.Context, z *Zone, client crv1.CacheRepositoryClient, remote *crv1.SummaryNode, items map[string]*crv1.CacheItem) error {
+	local, ok := z.Watcher.Summary(remote.Prefix)
+	if !ok {
+		return fmt.Errorf("peer sent an invalid summary prefix %q", remote.Prefix)
+	}
+
+	if remote.Count == 0 || bytes.Equal(local.Hash, remote.Hash) {
+		return nil
+	}
+
+	var differing []*crv1.SummaryNode
+	for i, child := range remote.Children {
+		if i < len(local.Children) && (child.Count == 0 || bytes.Equal(local.Children[i].Hash, child.Hash)) {
+			continue
+		}
+
+		differing = append(differing, child)
+	}
+
+	if pages := (remote.Count + crv1.DefaultPageSize - 1) / crv1.DefaultPageSize; len(remote.Children) == 0 || pages <= int64(len(differing)) {
+		return cm.list(ctx, z, client, remote.Prefix, items)
+	}
+
+	for _, child := range differing {
+		if child.Count <= crv1.DefaultPageSize { // its summary would not save any call
+			if err := cm.list(ctx, z, client, child.Prefix, items); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := client.Summary(ctx, &crv1.SummaryRequest{Zone: z.namespace(), Prefix: child.Prefix})
+		if err != nil {
+			return err
+		}
+
+		if err = cm.diffNode(ctx, z, client, r.Node, items); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list retrieves the cache entries of a peer whose IDs start with prefix,
+// following the pages until the last one.
+func (cm *CacheManager) list(ctx context.Context, z *Zone, client crv1.CacheRepositoryClient, prefix string, items map[string]*crv1.CacheItem) error {
+	var token string
+	for {
+		r, err := client.List(ctx, &crv1.ListRequest{Zone: z.namespace(), PageSize: crv1.DefaultPageSize, PageToken: token, Prefix: prefix})
+		if err != nil {
+			return err
+		}
+
+		for id, item := range r.Items {
+			items[id] = item
+		}
+
+		token = r.NextPageToken
+		if token == "" {
 			return nil
 		}
 	}
 }
 
 func (cm *CacheManager) handlePeers(ctx context.Context) {
+	added, removed := cm.Discoverer.Added(), cm.Discoverer.Removed()
+
 	for {
 		select {
-		case peer, isOpen := <-cm.Discoverer.Added():
+		case peer, isOpen := <-added:
 			if !isOpen {
 				cm.Logger.Error("Channel of added peers is closed")
+				added = nil
 				break
 			}
 
-			cm.addedPeer(peer)
+			cm.addedPeer(ctx, peer)
 
-		case peer, isOpen := <-cm.Discoverer.Removed():
+		case peer, isOpen := <-removed:
 			if !isOpen {
 				cm.Logger.Error("Channel of removed peers is closed")
+				removed = nil
 				break
 			}
 
-			cm.removedPeer(peer)
+			cm.removedPeer(peer.ID())
 
 		case <-ctx.Done():
 			return
@@ -106,19 +286,38 @@ func (cm *CacheManager) handlePeers(ctx context.Context) {
 	}
 }
 
-func (cm *CacheManager) addedPeer(peer string) {
-	_, ok := cm.peers.Load(peer)
+func (cm *CacheManager) addedPeer(ctx context.Context, peer sd.Peer) {
+	id := peer.ID()
+	node := cm.canonicalAddress(ctx, peer.Address(cm.Port))
+
+	if node == cm.self { // discoverers may report this very node
+		return
+	}
+
+	_, ok := cm.peers.Load(id)
 	if ok { // do nothing
 		return
 	}
 
-	conn, err := cm.dial(peer)
+	conn, err := cm.dial(peer.Address(cm.Port))
 	if err != nil {
-		cm.Logger.Error("Failed to open connection", zap.String("peer", peer), zap.Error(err))
+		cm.Logger.Error("Failed to open connection", zap.String("peer", id), zap.Error(err))
 		return
 	}
 
-	cm.peers.Store(peer, conn)
+	wctx, cancel := context.WithCancel(ctx)
+	pc := &peerConn{peer: peer, node: node, conn: conn, cancel: cancel, digests: make(map[string]*peerDigest)}
+	for _, z := range cm.Zones {
+		pc.digests[z.Name] = &peerDigest{}
+	}
+
+	cm.peers.Store(id, pc)
+	cm.updateRing()
+
+	for _, z := range cm.Zones {
+		go cm.refreshDigest(wctx, z, id, conn, pc.digests[z.Name])
+		go cm.watch(wctx, z, id, conn)
+	}
 }
 
 func (cm *CacheManager) removedPeer(peer string) {
@@ -127,27 +326,134 @@ func (cm *CacheManager) removedPeer(peer string) {
 		return
 	}
 
-	conn, ok := value.(*grpc.ClientConn)
+	pc, ok := value.(*peerConn)
 	if !ok {
 		return
 	}
 
-	if err := conn.Close(); err != nil {
+	pc.cancel()
+
+	if err := pc.conn.Close(); err != nil {
 		cm.Logger.Error("Failed to close connection", zap.String("peer", peer), zap.Error(err))
 	}
 
 	cm.peers.Delete(peer)
+	cm.updateRing()
+}
+
+// Owners returns the addresses of the nodes owning the cache entry id of a
+// zone, the primary owner first. It returns nil when the zone does not
+// replicate owned entries.
+func (cm *CacheManager) Owners(zone, id string) []string {
+	z, ok := cm.Zone(zone)
+	if !ok {
+		return nil
+	}
+
+	return cm.owners(z, id)
+}
+
+func (cm *CacheManager) owners(z *Zone, id string) []string {
+	r := cm.ring.Load()
+	if r == nil || cm.self == "" || z.Replication != ReplicateOwned {
+		return nil
+	}
+
+	return r.Owners(id, z.ReplicationFactor)
+}
+
+// owns reports whether this node should hold the cache entry id of a zone.
+func (cm *CacheManager) owns(z *Zone, id string) bool {
+	switch z.Replication {
+	case ReplicateNone:
+		return false
+
+	case ReplicateAll:
+		return true
+	}
+
+	r := cm.ring.Load()
+	if r == nil || cm.self == "" {
+		return true
+	}
+
+	return r.IsOwner(cm.self, id, z.ReplicationFactor)
+}
+
+// updateRing rebuilds the hash ring from the current peers and this node.
+func (cm *CacheManager) updateRing() {
+	cm.ringMu.Lock()
+	defer cm.ringMu.Unlock()
+
+	var nodes []string
+	if cm.self != "" {
+		nodes = append(nodes, cm.self)
+	}
+
+	cm.peers.Range(func(_, value any) bool {
+		nodes = append(nodes, value.(*peerConn).node)
+		return true
+	})
+
+	cm.ring.Store(ring.New(cm.VirtualNodes, nodes...))
+}
+
+// canonicalAddress returns address (host:port) with its host resolved to an IP
+// address, so that nodes reported by host name and by IP address are told
+// apart the same way on every node. The IPv4 addresses come first, the lowest
+// one being taken; address is returned as is when it cannot be resolved.
+func (cm *CacheManager) canonicalAddress(ctx context.Context, address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+
+	ips, err := cm.resolver().LookupIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return address
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		if a, b := ips[i].To4(), ips[j].To4(); (a == nil) != (b == nil) {
+			return a != nil
+		}
+
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+
+	return net.JoinHostPort(ips[0].String(), port)
+}
+
+func (cm *CacheManager) resolver() *net.Resolver {
+	if cm.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return cm.Resolver
 }
 
 func (cm *CacheManager) dial(address string) (conn *grpc.ClientConn, err error) {
-	target := fmt.Sprintf("dns:///%s:%d", address, cm.Port)
+	target := fmt.Sprintf("dns:///%s", address)
+
+	creds := cm.TransportCredentials
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
 
 	maxRetries := 20
 
 	for i := 0; i < maxRetries; i++ {
 		cm.Logger.Debug("Dialing to address", zap.String("target", target), zap.Int("attempt", i+1))
 
-		conn, err = grpc.Dial(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err = grpc.Dial(target,
+			grpc.WithTransportCredentials(creds),
+			grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), metrics.UnaryClientInterceptor),
+			grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), metrics.StreamClientInterceptor),
+		)
 		if err == nil {
 			return
 		}
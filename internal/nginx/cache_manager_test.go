@@ -0,0 +1,129 @@
+package nginx_test
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_Owners(t *testing.T) {
+	if _, err := net.LookupHost("localhost"); err != nil {
+		t.Skipf("no host name resolution available: %s", err)
+	}
+
+	// node.test is only known by the resolver given to the cache manager
+	resolver := newTestResolver(t, map[string]string{"node.test.": "127.0.0.1"})
+
+	for _, tt := range []struct {
+		name     string
+		self     string
+		peers    []string
+		resolver *net.Resolver
+	}{
+		{name: "host names", self: "localhost:8001", peers: []string{"localhost:8001", "localhost:8002"}},
+		{name: "self by host name", self: "localhost:8001", peers: []string{"127.0.0.1:8001", "127.0.0.1:8002"}},
+		{name: "self by IP", self: "127.0.0.1:8001", peers: []string{"localhost:8001", "localhost:8002"}},
+		{name: "mixed peers", self: "127.0.0.1:8001", peers: []string{"localhost:8001", "127.0.0.1:8002", "localhost:8002"}},
+		{name: "custom resolver", self: "node.test:8001", peers: []string{"node.test:8001", "node.test:8002"}, resolver: resolver},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+
+			var peers []sd.Peer
+			for _, p := range tt.peers {
+				peers = append(peers, parsePeer(t, p))
+			}
+
+			cm := &CacheManager{
+				Discoverer: &sd.StaticServiceDiscovery{Peers: peers},
+				Zones:      []*Zone{{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}, Replication: ReplicateOwned, ReplicationFactor: 3}},
+				Interval:   time.Hour,
+				Logger:     zap.NewNop(),
+				Self:       tt.self,
+				Resolver:   tt.resolver,
+			}
+
+			go cm.Reconcile(ctx)
+
+			// this node and its peer, once each whatever the way they are reported
+			expected := []string{"127.0.0.1:8001", "127.0.0.1:8002"}
+
+			require.Eventually(t, func() bool {
+				owners := cm.Owners("static", "0123456789abcdef0123456789abcdef")
+				sort.Strings(owners)
+				return assert.ObjectsAreEqual(expected, owners)
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// newTestResolver returns a resolver answering the A queries of the given
+// names (fully qualified) with their IP addresses, and NXDOMAIN otherwise.
+func newTestResolver(t *testing.T, hosts map[string]string) *net.Resolver {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+				Questions: msg.Questions,
+			}
+
+			for _, q := range msg.Questions {
+				ip, found := hosts[q.Name.String()]
+				if !found {
+					resp.RCode = dnsmessage.RCodeNameError
+					continue
+				}
+
+				if q.Type == dnsmessage.TypeA {
+					r := &dnsmessage.AResource{}
+					copy(r.A[:], net.ParseIP(ip).To4())
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1},
+						Body:   r,
+					})
+				}
+			}
+
+			if b, err := resp.Pack(); err == nil {
+				pc.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
@@ -0,0 +1,184 @@
+package nginx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Layout of ngx_http_file_cache_header_t (src/http/ngx_http_cache.h) as
+// written by nginx on 64-bit little-endian platforms, followed by the
+// "\nKEY: <key>\n" line.
+const (
+	CacheVersion = 5
+
+	cacheETagLen    = 128
+	cacheVaryLen    = 128
+	cacheVariantLen = 16
+
+	offsetVersion      = 0
+	offsetValidSec     = 8
+	offsetUpdatingSec  = 16
+	offsetErrorSec     = 24
+	offsetLastModified = 32
+	offsetDate         = 40
+	offsetCRC32        = 48
+	offsetValidMsec    = 52
+	offsetHeaderStart  = 54
+	offsetBodyStart    = 56
+	offsetETagLen      = 58
+	offsetETag         = offsetETagLen + 1
+	offsetVaryLen      = offsetETag + cacheETagLen
+	offsetVary         = offsetVaryLen + 1
+	offsetVariant      = offsetVary + cacheVaryLen
+
+	// CacheHeaderSize is the size of the binary header, including the
+	// trailing padding added by the C compiler.
+	CacheHeaderSize = (offsetVariant + cacheVariantLen + 7) &^ 7
+)
+
+var cacheKeyPrefix = []byte("\nKEY: ")
+
+var (
+	ErrUnknownVersion = errors.New("unknown cache file version")
+	ErrInvalidHeader  = errors.New("invalid cache file header")
+)
+
+// DecodeHeader reads the nginx cache file header from r, filling the header
+// fields of ce.
+func DecodeHeader(r io.Reader, ce *CacheEntry) error {
+	h := make([]byte, CacheHeaderSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidHeader, err)
+	}
+
+	le := binary.LittleEndian
+
+	ce.Version = le.Uint64(h[offsetVersion:])
+	if ce.Version != CacheVersion {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, ce.Version)
+	}
+
+	ce.ValidSec = unixTime(int64(le.Uint64(h[offsetValidSec:])))
+	ce.UpdatingSec = time.Duration(int64(le.Uint64(h[offsetUpdatingSec:]))) * time.Second
+	ce.ErrorSec = time.Duration(int64(le.Uint64(h[offsetErrorSec:]))) * time.Second
+	ce.LastModified = unixTime(int64(le.Uint64(h[offsetLastModified:])))
+	ce.Date = unixTime(int64(le.Uint64(h[offsetDate:])))
+	ce.CRC32 = le.Uint32(h[offsetCRC32:])
+	ce.ValidMsec = le.Uint16(h[offsetValidMsec:])
+	ce.HeaderStart = le.Uint16(h[offsetHeaderStart:])
+	ce.BodyStart = le.Uint16(h[offsetBodyStart:])
+
+	etagLen := int(h[offsetETagLen])
+	varyLen := int(h[offsetVaryLen])
+	if etagLen > cacheETagLen || varyLen > cacheVaryLen {
+		return fmt.Errorf("%w: etag or vary length out of bounds", ErrInvalidHeader)
+	}
+
+	ce.ETag = string(h[offsetETag : offsetETag+etagLen])
+	ce.Vary = string(h[offsetVary : offsetVary+varyLen])
+
+	if !ce.ValidSec.IsZero() {
+		ce.ValidSec = ce.ValidSec.Add(time.Duration(ce.ValidMsec) * time.Millisecond)
+	}
+
+	if int(ce.HeaderStart) < CacheHeaderSize+len(cacheKeyPrefix) || ce.BodyStart < ce.HeaderStart {
+		return fmt.Errorf("%w: header start %d, body start %d", ErrInvalidHeader, ce.HeaderStart, ce.BodyStart)
+	}
+
+	// The key line sits between the binary header and the HTTP headers.
+	line := make([]byte, int(ce.HeaderStart)-CacheHeaderSize)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidHeader, err)
+	}
+
+	if !bytes.HasPrefix(line, cacheKeyPrefix) {
+		return fmt.Errorf("%w: missing KEY line", ErrInvalidHeader)
+	}
+
+	line = line[len(cacheKeyPrefix):]
+
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return fmt.Errorf("%w: unterminated KEY line", ErrInvalidHeader)
+	}
+
+	ce.Key = string(line[:end])
+
+	return nil
+}
+
+// EncodeHeader writes the nginx cache file header of ce to w, up to the
+// HTTP response headers. HeaderStart and BodyStart are computed from the
+// key when left unset.
+func EncodeHeader(w io.Writer, ce CacheEntry) error {
+	if len(ce.ETag) > cacheETagLen || len(ce.Vary) > cacheVaryLen {
+		return fmt.Errorf("%w: etag or vary too long", ErrInvalidHeader)
+	}
+
+	headerStart := int(ce.HeaderStart)
+	if headerStart == 0 {
+		headerStart = CacheHeaderSize + len(cacheKeyPrefix) + len(ce.Key) + 1
+	}
+
+	if headerStart != CacheHeaderSize+len(cacheKeyPrefix)+len(ce.Key)+1 || headerStart > math.MaxUint16 {
+		return fmt.Errorf("%w: header start does not match the key", ErrInvalidHeader)
+	}
+
+	bodyStart := ce.BodyStart
+	if bodyStart == 0 {
+		bodyStart = uint16(headerStart)
+	}
+
+	version := ce.Version
+	if version == 0 {
+		version = CacheVersion
+	}
+
+	h := make([]byte, CacheHeaderSize)
+	le := binary.LittleEndian
+
+	le.PutUint64(h[offsetVersion:], version)
+	le.PutUint64(h[offsetValidSec:], uint64(timeUnix(ce.ValidSec)))
+	le.PutUint64(h[offsetUpdatingSec:], uint64(ce.UpdatingSec/time.Second))
+	le.PutUint64(h[offsetErrorSec:], uint64(ce.ErrorSec/time.Second))
+	le.PutUint64(h[offsetLastModified:], uint64(timeUnix(ce.LastModified)))
+	le.PutUint64(h[offsetDate:], uint64(timeUnix(ce.Date)))
+	le.PutUint32(h[offsetCRC32:], ce.CRC32)
+	le.PutUint16(h[offsetValidMsec:], ce.ValidMsec)
+	le.PutUint16(h[offsetHeaderStart:], uint16(headerStart))
+	le.PutUint16(h[offsetBodyStart:], bodyStart)
+	h[offsetETagLen] = byte(len(ce.ETag))
+	copy(h[offsetETag:], ce.ETag)
+	h[offsetVaryLen] = byte(len(ce.Vary))
+	copy(h[offsetVary:], ce.Vary)
+
+	h = append(h, cacheKeyPrefix...)
+	h = append(h, ce.Key...)
+	h = append(h, '\n')
+
+	_, err := w.Write(h)
+	return err
+}
+
+// unixTime converts a time_t from the cache header, treating non-positive
+// values (nginx uses -1 for unset) as zero time.
+func unixTime(sec int64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0)
+}
+
+func timeUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+
+	return t.Unix()
+}
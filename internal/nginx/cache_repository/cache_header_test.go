@@ -0,0 +1,79 @@
+package nginx_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+func TestUnmarshal(t *testing.T) {
+	expires := time.Now().Add(time.Minute).Truncate(time.Second)
+
+	var buf bytes.Buffer
+	require.NoError(t, EncodeHeader(&buf, CacheEntry{
+		ValidSec:     expires,
+		UpdatingSec:  10 * time.Second,
+		ErrorSec:     20 * time.Second,
+		LastModified: expires.Add(-time.Hour),
+		Date:         expires.Add(-time.Minute),
+		CRC32:        0xcafe,
+		ValidMsec:    250,
+		ETag:         `"abc"`,
+		Vary:         "Accept-Encoding",
+		Key:          "/greeting?name=nginx",
+	}))
+
+	headerStart := buf.Len()
+	buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+
+	assert.Equal(t, byte('\n'), buf.Bytes()[CacheHeaderSize])
+	assert.Equal(t, uint16(headerStart), binary.LittleEndian.Uint16(buf.Bytes()[54:]))
+
+	filename := filepath.Join(t.TempDir(), "3c4cd3d0e8e94e27a3f5cc6a8a2bb5c4")
+	require.NoError(t, os.WriteFile(filename, buf.Bytes(), 0o644))
+
+	ce, err := Unmarshal(filename)
+	require.NoError(t, err)
+
+	assert.Equal(t, "3c4cd3d0e8e94e27a3f5cc6a8a2bb5c4", ce.ID)
+	assert.Equal(t, int64(buf.Len()), ce.Size)
+	assert.Equal(t, uint64(CacheVersion), ce.Version)
+	assert.True(t, expires.Add(250*time.Millisecond).Equal(ce.ValidSec))
+	assert.Equal(t, 10*time.Second, ce.UpdatingSec)
+	assert.Equal(t, 20*time.Second, ce.ErrorSec)
+	assert.True(t, expires.Add(-time.Hour).Equal(ce.LastModified))
+	assert.True(t, expires.Add(-time.Minute).Equal(ce.Date))
+	assert.Equal(t, uint32(0xcafe), ce.CRC32)
+	assert.Equal(t, uint16(headerStart), ce.HeaderStart)
+	assert.Equal(t, uint16(headerStart), ce.BodyStart)
+	assert.Equal(t, `"abc"`, ce.ETag)
+	assert.Equal(t, "Accept-Encoding", ce.Vary)
+	assert.Equal(t, "/greeting?name=nginx", ce.Key)
+}
+
+func TestUnmarshal_UnknownVersion(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, EncodeHeader(&buf, CacheEntry{Version: 3, Key: "/"}))
+
+	filename := filepath.Join(t.TempDir(), "3c4cd3d0e8e94e27a3f5cc6a8a2bb5c4")
+	require.NoError(t, os.WriteFile(filename, buf.Bytes(), 0o644))
+
+	_, err := Unmarshal(filename)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+}
+
+func TestUnmarshal_Truncated(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "3c4cd3d0e8e94e27a3f5cc6a8a2bb5c4")
+	require.NoError(t, os.WriteFile(filename, []byte("not a cache file"), 0o644))
+
+	_, err := Unmarshal(filename)
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
@@ -1,54 +1,96 @@
 package nginx
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
 )
 
 type CacheEntry struct {
 	ID           string
 	Filename     string
+	Size         int64
 	Modification time.Time
 	RemovedAt    time.Time
-}
 
-type CacheWatcher struct {
-	Directory string
-	Logger    *zap.Logger
-
-	data    sync.Map
-	added   chan string
-	removed chan string
-	o       sync.Once
+	// Fields decoded from the nginx cache file header.
+	Version      uint64
+	ValidSec     time.Time     // when the entry expires, including ValidMsec
+	UpdatingSec  time.Duration // stale-while-revalidate window
+	ErrorSec     time.Duration // stale-if-error window
+	LastModified time.Time
+	Date         time.Time
+	CRC32        uint32
+	ValidMsec    uint16
+	HeaderStart  uint16 // offset of the upstream response headers
+	BodyStart    uint16 // offset of the response body
+	ETag         string
+	Vary         string
+	Key          string // value of proxy_cache_key
 }
 
-func (cw *CacheWatcher) Added() <-chan string {
-	cw.startChannels()
-	return cw.added
+// Expired reports whether the entry is no longer fresh at the given time.
+func (ce CacheEntry) Expired(now time.Time) bool {
+	return !ce.ValidSec.IsZero() && !ce.ValidSec.After(now)
 }
 
-func (cw *CacheWatcher) Removed() <-chan string {
-	cw.startChannels()
-	return cw.removed
+const (
+	// DefaultExpireInterval is how often expired entries are dropped from the
+	// index by default.
+	DefaultExpireInterval = 10 * time.Second
+	// DefaultTombstoneTTL is how long deleted entries are remembered by default.
+	DefaultTombstoneTTL = time.Hour
+)
+
+type CacheWatcher struct {
+	Directory string
+	Logger    *zap.Logger
+	// JournalSize is how many recent events are kept for resuming subscribers.
+	JournalSize int
+	// ExpireInterval is how often expired entries are dropped from the index.
+	// Their files are left for nginx, which re-adds them once revalidated.
+	ExpireInterval time.Duration
+	// TombstoneTTL is how long entries deleted on purpose are remembered, so
+	// they are not replicated back from peers meanwhile.
+	TombstoneTTL time.Duration
+
+	data       sync.Map
+	tombstones sync.Map // CacheEntry with RemovedAt, by ID
+	o          sync.Once
+	journal    *journal
+	tree       merkle
+	index      index
+	entries    atomic.Int64 // number of entries indexed
+	bytes      atomic.Int64 // size of the entries indexed
+	synced     atomic.Bool  // whether the initial scan of the directory is done
 }
 
+// Watch indexes the cache directory and keeps following its changes until ctx
+// is done. Changes are recorded in order on a journal, which subscribers
+// follow through Events.
 func (cw *CacheWatcher) Watch(ctx context.Context) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	cw.startChannels()
-	defer close(cw.added)
-	defer close(cw.removed)
+	if cw.Logger == nil {
+		cw.Logger = zap.NewNop()
+	}
+
+	cw.init()
 
 	if ok, _ := IsDir(cw.Directory); !ok {
 		return errors.New("path is not directory")
@@ -64,22 +106,66 @@ func (cw *CacheWatcher) Watch(ctx context.Context) error {
 		return err
 	}
 
+	cw.synced.Store(true)
+	defer cw.synced.Store(false)
+
+	if cw.ExpireInterval <= 0 {
+		cw.ExpireInterval = DefaultExpireInterval
+	}
+
+	ticker := time.NewTicker(cw.ExpireInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
+		case now := <-ticker.C:
+			cw.expire(now)
+			cw.expireTombstones(now)
+
 		case evt, ok := <-watcher.Events:
 			if !ok {
 				return fmt.Errorf("events channel is closed")
 			}
 
-			go cw.handleEvent(watcher, evt)
+			for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod} {
+				if evt.Has(op) {
+					metrics.FilesystemEvents.WithLabelValues(strings.ToLower(op.String())).Inc()
+				}
+			}
+
+			// handled in order, so a file created and removed right after
+			// is never left indexed nor journaled the other way around
+			cw.handleEvent(watcher, evt)
 
 		case <-ctx.Done():
-			fmt.Println("Context canceled, finishing watcher...")
+			cw.Logger.Debug("Context canceled, finishing watcher")
 			return nil
 		}
 	}
 }
 
+// Events returns the events recorded after the given sequence number of the
+// current epoch, plus a channel that is closed when a new event is recorded.
+// When epoch does not match, or seq is older than the kept events, ok is false
+// and the caller must resynchronize (e.g. through List).
+func (cw *CacheWatcher) Events(epoch, seq uint64) (events []CacheEvent, changed <-chan struct{}, ok bool) {
+	cw.init()
+
+	current, _ := cw.journal.head()
+	if epoch != current {
+		_, changed, _ = cw.journal.since(0)
+		return nil, changed, false
+	}
+
+	return cw.journal.since(seq)
+}
+
+// Head returns the current epoch and the sequence number of the last event.
+func (cw *CacheWatcher) Head() (epoch, seq uint64) {
+	cw.init()
+	return cw.journal.head()
+}
+
 func (cw *CacheWatcher) Keys() (keys []string) {
 	cw.data.Range(func(key, _ any) bool {
 		keys = append(keys, key.(string))
@@ -89,6 +175,86 @@ func (cw *CacheWatcher) Keys() (keys []string) {
 	return
 }
 
+// Synced reports whether the index reflects the cache directory, i.e. Watch
+// finished the initial scan and is still running.
+func (cw *CacheWatcher) Synced() bool {
+	return cw.synced.Load()
+}
+
+// Stats returns the number of entries indexed and their total size.
+func (cw *CacheWatcher) Stats() (entries int, bytes int64) {
+	return int(cw.entries.Load()), cw.bytes.Load()
+}
+
+// Get returns the cache entry indexed by key, if any.
+func (cw *CacheWatcher) Get(key string) (CacheEntry, bool) {
+	value, found := cw.data.Load(key)
+	if !found {
+		return CacheEntry{}, false
+	}
+
+	return value.(CacheEntry), true
+}
+
+// List returns up to limit entries starting with prefix whose keys sort after
+// the given key, in ascending key order, skipping expired entries. The
+// returned next key is empty when there are no more entries; otherwise it
+// should be passed as after on the next call.
+func (cw *CacheWatcher) List(prefix, after string, limit int) (entries []CacheEntry, next string) {
+	return cw.Scan(prefix, after, limit, 0, nil)
+}
+
+// Scan is List skipping the entries whose keys do not match (none when match
+// is nil), looking at up to scan entries (no limit when zero). Once that many
+// are looked at, the entries found so far are returned, possibly none, with
+// the last key looked at as next.
+func (cw *CacheWatcher) Scan(prefix, after string, limit, scan int, match func(key string) bool) (entries []CacheEntry, next string) {
+	now := time.Now()
+
+	var (
+		scanned int
+		last    string // the ID last looked at
+	)
+
+	entries = []CacheEntry{}
+	cw.index.ascend(prefix, after, func(id string) bool {
+		if scan > 0 && scanned == scan {
+			next = last
+			return false
+		}
+
+		scanned++
+		last = id
+
+		ce, found := cw.Get(id)
+		if !found || ce.Expired(now) { // entry might be removed meanwhile
+			return true
+		}
+
+		if match != nil && !match(ce.Key) {
+			return true
+		}
+
+		if limit > 0 && len(entries) == limit {
+			next = entries[limit-1].ID
+			return false
+		}
+
+		entries = append(entries, ce)
+		return true
+	})
+
+	return
+}
+
+// Summary returns the node of the index's Merkle tree covering the entries
+// whose IDs start with prefix (empty for the root), with its children. It
+// reports false when prefix is not made of up to SummaryDepth lowercase hex
+// digits.
+func (cw *CacheWatcher) Summary(prefix string) (SummaryNode, bool) {
+	return cw.tree.node(prefix)
+}
+
 func (cw *CacheWatcher) fullSync(watcher *fsnotify.Watcher, dir string) error {
 	return filepath.WalkDir(dir, fs.WalkDirFunc(func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -116,26 +282,25 @@ func (cw *CacheWatcher) fullSync(watcher *fsnotify.Watcher, dir string) error {
 func (cw *CacheWatcher) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Event) {
 	filename := event.Name
 
+	if event.Op.Has(fsnotify.Create) {
+		if ok, _ := IsDir(filename); ok { // e.g. new levels subdirectory
+			if err := cw.fullSync(watcher, filename); err != nil {
+				cw.Logger.Error("Failed to sync directory", zap.String("directory", filename), zap.Error(err))
+			}
+			return
+		}
+	}
+
 	if len(filepath.Base(filename)) != 32 { // ignoring temporary file :P
 		return
 	}
 
 	if event.Op.Has(fsnotify.Create) || event.Op.Has(fsnotify.Write) {
-		if ok, _ := IsDir(filename); ok {
-			watcher.Add(filename)
-			return
-		}
-
 		cw.addFile(filename)
 		return
 	}
 
-	if event.Op.Has(fsnotify.Remove) {
-		if ok, _ := IsDir(filename); ok {
-			watcher.Remove(filename)
-			return
-		}
-
+	if event.Op.Has(fsnotify.Remove) || event.Op.Has(fsnotify.Rename) {
 		cw.deleteFile(filename)
 		return
 	}
@@ -144,38 +309,190 @@ func (cw *CacheWatcher) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Ev
 func (cw *CacheWatcher) addFile(filename string) {
 	ce, err := Unmarshal(filename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to unmarshal cache entry: %s\n", err)
+		cw.Logger.Debug("Failed to unmarshal cache entry", zap.String("filename", filename), zap.Error(err))
+		return
+	}
+
+	if ce.Expired(time.Now()) {
+		cw.deleteFile(filename)
+		return
 	}
 
 	key := filepath.Base(filename)
 
-	_, found := cw.data.Swap(key, ce)
-	if !found {
-		cw.added <- key
-	}
+	cw.journal.record(EventAdded, func() (CacheEntry, bool) {
+		old, found := cw.data.Swap(key, ce)
+		if found {
+			cw.bytes.Add(ce.Size - old.(CacheEntry).Size)
+		} else {
+			cw.tree.add(key)
+			cw.index.add(key)
+			cw.entries.Add(1)
+			cw.bytes.Add(ce.Size)
+		}
+		return ce, !found
+	})
 }
 
 func (cw *CacheWatcher) deleteFile(filename string) {
 	key := filepath.Base(filename)
-	cw.data.Delete(key)
-	cw.removed <- key
+
+	cw.journal.record(EventRemoved, func() (CacheEntry, bool) {
+		value, found := cw.data.LoadAndDelete(key)
+		if !found {
+			return CacheEntry{}, false
+		}
+		cw.tree.remove(key)
+		cw.index.remove(key)
+		cw.entries.Add(-1)
+		cw.bytes.Add(-value.(CacheEntry).Size)
+		return value.(CacheEntry), true
+	})
+}
+
+// Tombstone deletes the entry ce.ID on purpose, remembering it for the
+// tombstone TTL counted from ce.RemovedAt (now, when zero). It reports false
+// when the tombstone was already known or is expired; otherwise a tombstone
+// event is recorded for peers to follow.
+func (cw *CacheWatcher) Tombstone(ce CacheEntry) (bool, error) {
+	cw.init()
+
+	if ce.RemovedAt.IsZero() {
+		ce.RemovedAt = time.Now()
+	}
+
+	if !cw.tombstoneExpiry(ce).After(time.Now()) {
+		return false, nil
+	}
+
+	var recorded bool
+	cw.journal.record(EventTombstoned, func() (CacheEntry, bool) {
+		if value, found := cw.tombstones.Load(ce.ID); found && !value.(CacheEntry).RemovedAt.Before(ce.RemovedAt) {
+			return CacheEntry{}, false
+		}
+
+		if local, found := cw.data.Load(ce.ID); found {
+			removedAt := ce.RemovedAt
+			ce = local.(CacheEntry)
+			ce.RemovedAt = removedAt
+		}
+
+		cw.tombstones.Store(ce.ID, ce)
+		recorded = true
+
+		return ce, true
+	})
+
+	if !recorded {
+		return false, nil
+	}
+
+	local, found := cw.Get(ce.ID)
+	if !found {
+		return true, nil
+	}
+
+	if err := os.Remove(local.Filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return true, err
+	}
+
+	cw.deleteFile(local.Filename)
+
+	return true, nil
+}
+
+// Tombstoned reports whether the entry id was deleted on purpose recently.
+func (cw *CacheWatcher) Tombstoned(id string) bool {
+	value, found := cw.tombstones.Load(id)
+	return found && cw.tombstoneExpiry(value.(CacheEntry)).After(time.Now())
+}
+
+// Tombstones returns the entries deleted on purpose which are still
+// remembered.
+func (cw *CacheWatcher) Tombstones() (entries []CacheEntry) {
+	now := time.Now()
+
+	cw.tombstones.Range(func(_, value any) bool {
+		if ce := value.(CacheEntry); cw.tombstoneExpiry(ce).After(now) {
+			entries = append(entries, ce)
+		}
+		return true
+	})
+
+	return
+}
+
+func (cw *CacheWatcher) tombstoneExpiry(ce CacheEntry) time.Time {
+	ttl := cw.TombstoneTTL
+	if ttl <= 0 {
+		ttl = DefaultTombstoneTTL
+	}
+
+	return ce.RemovedAt.Add(ttl)
+}
+
+func (cw *CacheWatcher) expireTombstones(now time.Time) {
+	cw.tombstones.Range(func(key, value any) bool {
+		if !cw.tombstoneExpiry(value.(CacheEntry)).After(now) {
+			cw.tombstones.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+// expire drops from the index the entries which expired by now.
+func (cw *CacheWatcher) expire(now time.Time) {
+	cw.data.Range(func(key, value any) bool {
+		ce := value.(CacheEntry)
+		if !ce.Expired(now) {
+			return true
+		}
+
+		cw.journal.record(EventRemoved, func() (CacheEntry, bool) {
+			found := cw.data.CompareAndDelete(key, ce) // not replaced meanwhile
+			if found {
+				cw.tree.remove(key.(string))
+				cw.index.remove(key.(string))
+				cw.entries.Add(-1)
+				cw.bytes.Add(-ce.Size)
+			}
+			return ce, found
+		})
+
+		return true
+	})
 }
 
-func (cw *CacheWatcher) startChannels() {
-	cw.o.Do(func() { cw.added, cw.removed = make(chan string), make(chan string) })
+func (cw *CacheWatcher) init() {
+	cw.o.Do(func() {
+		cw.journal = newJournal(cw.JournalSize)
+	})
 }
 
 func Unmarshal(filename string) (CacheEntry, error) {
-	fi, err := os.Stat(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return CacheEntry{}, err
 	}
+	defer f.Close()
 
-	return CacheEntry{
+	fi, err := f.Stat()
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	ce := CacheEntry{
 		ID:           filepath.Base(filename),
 		Filename:     filename,
+		Size:         fi.Size(),
 		Modification: fi.ModTime(),
-	}, nil
+	}
+
+	if err := DecodeHeader(bufio.NewReader(f), &ce); err != nil {
+		return CacheEntry{}, err
+	}
+
+	return ce, nil
 }
 
 func IsDir(name string) (bool, error) {
@@ -0,0 +1,176 @@
+package nginx_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+func TestCacheWatcher_List(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cw := &CacheWatcher{Directory: t.TempDir()}
+
+	var ids []string
+	for i := 0; i < 50; i++ {
+		ids = append(ids, writeEntry(t, cw.Directory, fmt.Sprintf("/%d", i), time.Now().Add(time.Hour)))
+	}
+
+	soon := time.Now().Add(time.Second)
+	writeEntry(t, cw.Directory, "/expired", soon)
+
+	go cw.Watch(ctx)
+	require.Eventually(t, func() bool { return len(cw.Keys()) == 51 }, 5*time.Second, 10*time.Millisecond)
+
+	sort.Strings(ids)
+
+	list := func(prefix string, limit int) (listed []string, pages int) {
+		var after string
+		for {
+			entries, next := cw.List(prefix, after, limit)
+			for _, ce := range entries {
+				listed = append(listed, ce.ID)
+			}
+
+			if pages++; next == "" {
+				return
+			}
+
+			after = next
+		}
+	}
+
+	time.Sleep(time.Until(soon)) // expired, yet still indexed until the next expire tick
+
+	listed, pages := list("", 7)
+	assert.Equal(t, ids, listed)
+	assert.Equal(t, 8, pages)
+
+	prefix := ids[0][:1]
+
+	var withPrefix []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, prefix) {
+			withPrefix = append(withPrefix, id)
+		}
+	}
+
+	listed, _ = list(prefix, 2)
+	assert.Equal(t, withPrefix, listed)
+
+	entries, next := cw.List("", ids[len(ids)-1], 10)
+	assert.Empty(t, entries)
+	assert.Empty(t, next)
+
+	t.Run("scan", func(t *testing.T) {
+		match := func(key string) bool { return strings.HasSuffix(key, "7") } // /7, /17, ..., /47
+
+		var (
+			keys  []string
+			after string
+			pages int
+		)
+		for {
+			entries, next := cw.Scan("", after, 2, 10, match)
+			for _, ce := range entries {
+				keys = append(keys, ce.Key)
+			}
+
+			if pages++; next == "" {
+				break
+			}
+
+			after = next
+		}
+
+		assert.ElementsMatch(t, []string{"/7", "/17", "/27", "/37", "/47"}, keys)
+		assert.Equal(t, 6, pages, "ten entries looked at on each page")
+	})
+}
+
+func BenchmarkCacheWatcher_List(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cw := &CacheWatcher{Directory: b.TempDir()}
+	for i := 0; i < 10000; i++ {
+		writeEntry(b, cw.Directory, fmt.Sprintf("/%d", i), time.Now().Add(time.Hour))
+	}
+
+	go cw.Watch(ctx)
+	require.Eventually(b, func() bool { return len(cw.Keys()) == 10000 }, time.Minute, 10*time.Millisecond)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cw.List("", "8", 100)
+	}
+}
+
+// writeEntry writes a cache file of key valid until the given time, returning
+// its ID.
+func writeEntry(tb testing.TB, dir, key string, valid time.Time) string {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(tb, EncodeHeader(&buf, CacheEntry{Key: key, ValidSec: valid}))
+	buf.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+
+	sum := md5.Sum([]byte(key))
+	id := hex.EncodeToString(sum[:])
+	require.NoError(tb, os.WriteFile(filepath.Join(dir, id), buf.Bytes(), 0o644))
+
+	return id
+}
+
+func TestCacheWatcher_Watch_CreateAndRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cw := &CacheWatcher{Directory: t.TempDir()}
+
+	go cw.Watch(ctx)
+	require.Eventually(t, cw.Synced, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 200; i++ {
+		id := writeEntry(t, cw.Directory, fmt.Sprintf("/%d", i), time.Now().Add(time.Hour))
+		require.NoError(t, os.Remove(filepath.Join(cw.Directory, id)))
+	}
+
+	// a marker entry, handled after every event above
+	marker := writeEntry(t, cw.Directory, "/marker", time.Now().Add(time.Hour))
+	require.Eventually(t, func() bool { _, found := cw.Get(marker); return found }, 5*time.Second, 10*time.Millisecond)
+
+	entries, _ := cw.Stats()
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, []string{marker}, cw.Keys())
+
+	epoch, _ := cw.Head()
+	events, _, ok := cw.Events(epoch, 0)
+	require.True(t, ok)
+
+	last := make(map[string]EventType)
+	for _, evt := range events {
+		last[evt.Entry.ID] = evt.Type
+	}
+
+	for id, typ := range last {
+		if id != marker {
+			assert.Equal(t, EventRemoved, typ, id)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package nginx
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// index keeps the IDs of the cache entries sorted, so pages of them are found
+// without going through the whole cache.
+type index struct {
+	mu   sync.RWMutex
+	tree *btree.BTreeG[string]
+}
+
+func (ix *index) add(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.tree == nil {
+		ix.tree = btree.NewOrderedG[string](32)
+	}
+
+	ix.tree.ReplaceOrInsert(id)
+}
+
+func (ix *index) remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.tree != nil {
+		ix.tree.Delete(id)
+	}
+}
+
+// ascend calls fn with the IDs starting with prefix which sort after the
+// given one, in ascending order, until fn returns false.
+func (ix *index) ascend(prefix, after string, fn func(id string) bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if ix.tree == nil {
+		return
+	}
+
+	pivot := prefix
+	if after > pivot {
+		pivot = after
+	}
+
+	ix.tree.AscendGreaterOrEqual(pivot, func(id string) bool {
+		if id == after {
+			return true
+		}
+
+		if !strings.HasPrefix(id, prefix) { // past the IDs with prefix
+			return false
+		}
+
+		return fn(id)
+	})
+}
@@ -0,0 +1,104 @@
+package nginx
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultJournalSize = 4096
+
+type EventType int
+
+const (
+	EventAdded EventType = iota + 1
+	EventRemoved
+	// EventTombstoned marks an entry deleted on purpose (e.g. purged), which
+	// peers must delete as well; the entry carries RemovedAt.
+	EventTombstoned
+)
+
+// CacheEvent is a change in the cache index. Sequence numbers increase by one
+// on each event and are only meaningful within the same Epoch.
+type CacheEvent struct {
+	Sequence uint64
+	Epoch    uint64
+	Type     EventType
+	Entry    CacheEntry
+}
+
+// journal keeps the most recent cache events so subscribers can resume from
+// a sequence number after reconnecting.
+type journal struct {
+	mu      sync.Mutex
+	epoch   uint64
+	seq     uint64
+	events  []CacheEvent // ring buffer
+	size    int
+	changed chan struct{}
+}
+
+func newJournal(size int) *journal {
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+
+	return &journal{
+		epoch:   uint64(time.Now().UnixNano()),
+		events:  make([]CacheEvent, 0, size),
+		size:    size,
+		changed: make(chan struct{}),
+	}
+}
+
+// record runs mutate and, when it reports a change, appends the event while
+// holding the journal lock, so the event order matches the index order.
+func (j *journal) record(typ EventType, mutate func() (CacheEntry, bool)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ce, changed := mutate()
+	if !changed {
+		return
+	}
+
+	j.seq++
+	evt := CacheEvent{Sequence: j.seq, Epoch: j.epoch, Type: typ, Entry: ce}
+
+	if len(j.events) < j.size {
+		j.events = append(j.events, evt)
+	} else {
+		j.events[int((j.seq-1)%uint64(j.size))] = evt
+	}
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// since returns the events after seq, along with a channel closed on the next
+// change. ok is false when events after seq were already discarded.
+func (j *journal) since(seq uint64) (events []CacheEvent, changed <-chan struct{}, ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq > j.seq {
+		return nil, j.changed, false
+	}
+
+	oldest := j.seq - uint64(len(j.events)) // sequence right before the oldest kept event
+	if seq < oldest {
+		return nil, j.changed, false
+	}
+
+	for s := seq + 1; s <= j.seq; s++ {
+		events = append(events, j.events[int((s-1)%uint64(j.size))])
+	}
+
+	return events, j.changed, true
+}
+
+func (j *journal) head() (epoch, seq uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.epoch, j.seq
+}
@@ -0,0 +1,52 @@
+package nginx
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ParseLevels parses the levels parameter of proxy_cache_path (e.g. "1:2").
+// An empty string means a flat directory, nginx's default.
+func ParseLevels(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid levels %q: at most 3 levels are allowed", s)
+	}
+
+	levels := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 2 {
+			return nil, fmt.Errorf("invalid levels %q: each level must be 1 or 2", s)
+		}
+
+		levels = append(levels, n)
+	}
+
+	return levels, nil
+}
+
+// CachePath returns where nginx stores the cache file with the given ID (md5
+// of the cache key) inside dir. Subdirectory names are taken from the end of
+// the ID, e.g. levels 1:2 puts "b7f5...029c" into "c/29/b7f5...029c".
+func CachePath(dir string, levels []int, id string) string {
+	elems := []string{dir}
+
+	end := len(id)
+	for _, n := range levels {
+		if end-n < 0 {
+			break
+		}
+
+		elems = append(elems, id[end-n:end])
+		end -= n
+	}
+
+	return filepath.Join(append(elems, id)...)
+}
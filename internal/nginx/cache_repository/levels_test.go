@@ -0,0 +1,33 @@
+package nginx_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels("1:2")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, levels)
+
+	levels, err = ParseLevels("")
+	require.NoError(t, err)
+	assert.Empty(t, levels)
+
+	for _, invalid := range []string{"3", "1:2:1:1", "a", "1:"} {
+		_, err = ParseLevels(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCachePath(t *testing.T) {
+	id := "b7f54b2df7773722d382f4809d65029c"
+
+	assert.Equal(t, "/cache/b7f54b2df7773722d382f4809d65029c", CachePath("/cache", nil, id))
+	assert.Equal(t, "/cache/c/29/b7f54b2df7773722d382f4809d65029c", CachePath("/cache", []int{1, 2}, id))
+	assert.Equal(t, "/cache/9c/02/5/b7f54b2df7773722d382f4809d65029c", CachePath("/cache", []int{2, 2, 1}, id))
+}
@@ -0,0 +1,103 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KeyMatcher reports whether a cache key (proxy_cache_key) matches.
+type KeyMatcher func(key string) bool
+
+// ExactKey matches the cache key equal to key.
+func ExactKey(key string) KeyMatcher {
+	return func(k string) bool { return k == key }
+}
+
+// KeyPrefix matches the cache keys starting with prefix.
+func KeyPrefix(prefix string) KeyMatcher {
+	return func(k string) bool { return strings.HasPrefix(k, prefix) }
+}
+
+// KeyPattern matches the cache keys against a glob: "*" matches any sequence
+// of characters (including "/", unlike path.Match), "?" any single character,
+// "[...]" a character class ("[!...]" negated) and "\" escapes the next
+// character.
+func KeyPattern(pattern string) (KeyMatcher, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString("(?s:.*)")
+
+		case '?':
+			b.WriteString("(?s:.)")
+
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, fmt.Errorf("invalid pattern %q: trailing escape", pattern)
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern %q: unterminated character class", pattern)
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	return re.MatchString, nil
+}
+
+// Purge deletes the entries whose cache keys match, tombstoning them (see
+// Tombstone) so peers delete them as well. It returns the entries purged.
+func (cw *CacheWatcher) Purge(match KeyMatcher) (purged []CacheEntry, err error) {
+	var matched []CacheEntry
+	cw.data.Range(func(_, value any) bool {
+		if ce := value.(CacheEntry); match(ce.Key) {
+			matched = append(matched, ce)
+		}
+		return true
+	})
+
+	now := time.Now()
+
+	var errs []error
+	for _, ce := range matched {
+		ce.RemovedAt = now
+
+		applied, terr := cw.Tombstone(ce)
+		if terr != nil {
+			errs = append(errs, fmt.Errorf("failed to purge cache entry %s: %w", ce.ID, terr))
+		}
+
+		if applied {
+			purged = append(purged, ce)
+		}
+	}
+
+	return purged, errors.Join(errs...)
+}
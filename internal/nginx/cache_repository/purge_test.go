@@ -0,0 +1,34 @@
+package nginx_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+func TestKeyPattern(t *testing.T) {
+	match, err := KeyPattern("httpGETexample.com/images/*.png")
+	require.NoError(t, err)
+	assert.True(t, match("httpGETexample.com/images/a/b/c.png"))
+	assert.False(t, match("httpGETexample.com/images/a.jpg"))
+	assert.False(t, match("httpGETexample.com/images/a.png?v=1"))
+
+	match, err = KeyPattern(`/a?c[!x]\*`)
+	require.NoError(t, err)
+	assert.True(t, match("/abcd*"))
+	assert.False(t, match("/abcx*"))
+	assert.False(t, match("/abcde"))
+
+	match, err = KeyPattern("/a.b(c)")
+	require.NoError(t, err)
+	assert.True(t, match("/a.b(c)"))
+	assert.False(t, match("/axb(c)"))
+
+	for _, invalid := range []string{"/a[b", `/a\`, "/[z-a]"} {
+		_, err = KeyPattern(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,124 @@
+package nginx
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SummaryDepth is the number of hex digits of the cache entry ID used to
+// bucket the index: 16^SummaryDepth leaves.
+const SummaryDepth = 3
+
+// SummaryNode is a node of the Merkle tree built over the cache index. The
+// tree is 16-ary: each level takes one more hex digit of the entry IDs.
+type SummaryNode struct {
+	Prefix string
+	Hash   []byte
+	Count  int
+	// Children are the nodes one level below, Children[i] having the prefix
+	// Prefix plus the i-th hex digit; nil on leaves.
+	Children []SummaryNode
+}
+
+// merkle keeps the leaves of the Merkle tree up to date as entries come and
+// go. A leaf is the XOR of the IDs in its bucket, so it can be updated in
+// constant time both ways. Nodes are hashed on demand and cached until one of
+// the leaves below them changes.
+type merkle struct {
+	mu     sync.Mutex
+	leaves [1 << (4 * SummaryDepth)]struct {
+		xor   [16]byte
+		count int
+	}
+	hashes map[string]SummaryNode // by prefix, without children
+}
+
+func (m *merkle) add(id string)    { m.toggle(id, 1) }
+func (m *merkle) remove(id string) { m.toggle(id, -1) }
+
+func (m *merkle) toggle(id string, delta int) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 { // not an md5, never shared anyway
+		return
+	}
+
+	n, _ := strconv.ParseUint(id[:SummaryDepth], 16, 32)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leaf := &m.leaves[n]
+	for i := range b {
+		leaf.xor[i] ^= b[i]
+	}
+	leaf.count += delta
+
+	for i := 0; i <= SummaryDepth; i++ {
+		delete(m.hashes, id[:i])
+	}
+}
+
+// node returns the tree node of prefix, along with its direct children.
+func (m *merkle) node(prefix string) (SummaryNode, bool) {
+	if !validPrefix(prefix) {
+		return SummaryNode{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.hash(prefix)
+	if len(prefix) < SummaryDepth {
+		n.Children = make([]SummaryNode, 16)
+		for i := range n.Children {
+			n.Children[i] = m.hash(prefix + strconv.FormatUint(uint64(i), 16))
+		}
+	}
+
+	return n, true
+}
+
+func (m *merkle) hash(prefix string) SummaryNode {
+	if n, ok := m.hashes[prefix]; ok {
+		return n
+	}
+
+	h := sha256.New()
+	n := SummaryNode{Prefix: prefix}
+
+	if len(prefix) == SummaryDepth {
+		i, _ := strconv.ParseUint(prefix, 16, 32)
+		leaf := m.leaves[i]
+
+		h.Write(leaf.xor[:])
+		binary.Write(h, binary.BigEndian, uint64(leaf.count))
+		n.Count = leaf.count
+	} else {
+		for i := 0; i < 16; i++ {
+			child := m.hash(prefix + strconv.FormatUint(uint64(i), 16))
+			h.Write(child.Hash)
+			n.Count += child.Count
+		}
+	}
+
+	n.Hash = h.Sum(nil)
+
+	if m.hashes == nil {
+		m.hashes = make(map[string]SummaryNode)
+	}
+	m.hashes[prefix] = n
+
+	return n
+}
+
+func validPrefix(prefix string) bool {
+	if len(prefix) > SummaryDepth {
+		return false
+	}
+
+	return strings.Trim(prefix, "0123456789abcdef") == ""
+}
@@ -19,7 +19,14 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	CacheRepository_List_FullMethodName = "/cache_repository_v1.CacheRepository/List"
+	CacheRepository_List_FullMethodName       = "/cache_repository_v1.CacheRepository/List"
+	CacheRepository_Fetch_FullMethodName      = "/cache_repository_v1.CacheRepository/Fetch"
+	CacheRepository_Watch_FullMethodName      = "/cache_repository_v1.CacheRepository/Watch"
+	CacheRepository_Summary_FullMethodName    = "/cache_repository_v1.CacheRepository/Summary"
+	CacheRepository_Digest_FullMethodName     = "/cache_repository_v1.CacheRepository/Digest"
+	CacheRepository_Tombstones_FullMethodName = "/cache_repository_v1.CacheRepository/Tombstones"
+	CacheRepository_Purge_FullMethodName      = "/cache_repository_v1.CacheRepository/Purge"
+	CacheRepository_HandOff_FullMethodName    = "/cache_repository_v1.CacheRepository/HandOff"
 )
 
 // CacheRepositoryClient is the client API for CacheRepository service.
@@ -27,6 +34,13 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CacheRepositoryClient interface {
 	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (CacheRepository_FetchClient, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CacheRepository_WatchClient, error)
+	Summary(ctx context.Context, in *SummaryRequest, opts ...grpc.CallOption) (*SummaryResponse, error)
+	Digest(ctx context.Context, in *DigestRequest, opts ...grpc.CallOption) (*DigestResponse, error)
+	Tombstones(ctx context.Context, in *TombstonesRequest, opts ...grpc.CallOption) (*TombstonesResponse, error)
+	Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error)
+	HandOff(ctx context.Context, in *HandOffRequest, opts ...grpc.CallOption) (*HandOffResponse, error)
 }
 
 type cacheRepositoryClient struct {
@@ -46,11 +60,127 @@ func (c *cacheRepositoryClient) List(ctx context.Context, in *ListRequest, opts
 	return out, nil
 }
 
+func (c *cacheRepositoryClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (CacheRepository_FetchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CacheRepository_ServiceDesc.Streams[0], CacheRepository_Fetch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheRepositoryFetchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CacheRepository_FetchClient interface {
+	Recv() (*FetchResponse, error)
+	grpc.ClientStream
+}
+
+type cacheRepositoryFetchClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheRepositoryFetchClient) Recv() (*FetchResponse, error) {
+	m := new(FetchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *cacheRepositoryClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CacheRepository_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CacheRepository_ServiceDesc.Streams[1], CacheRepository_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheRepositoryWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CacheRepository_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type cacheRepositoryWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheRepositoryWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *cacheRepositoryClient) Summary(ctx context.Context, in *SummaryRequest, opts ...grpc.CallOption) (*SummaryResponse, error) {
+	out := new(SummaryResponse)
+	err := c.cc.Invoke(ctx, CacheRepository_Summary_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheRepositoryClient) Digest(ctx context.Context, in *DigestRequest, opts ...grpc.CallOption) (*DigestResponse, error) {
+	out := new(DigestResponse)
+	err := c.cc.Invoke(ctx, CacheRepository_Digest_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheRepositoryClient) Tombstones(ctx context.Context, in *TombstonesRequest, opts ...grpc.CallOption) (*TombstonesResponse, error) {
+	out := new(TombstonesResponse)
+	err := c.cc.Invoke(ctx, CacheRepository_Tombstones_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheRepositoryClient) Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error) {
+	out := new(PurgeResponse)
+	err := c.cc.Invoke(ctx, CacheRepository_Purge_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheRepositoryClient) HandOff(ctx context.Context, in *HandOffRequest, opts ...grpc.CallOption) (*HandOffResponse, error) {
+	out := new(HandOffResponse)
+	err := c.cc.Invoke(ctx, CacheRepository_HandOff_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CacheRepositoryServer is the server API for CacheRepository service.
 // All implementations must embed UnimplementedCacheRepositoryServer
 // for forward compatibility
 type CacheRepositoryServer interface {
 	List(context.Context, *ListRequest) (*ListResponse, error)
+	Fetch(*FetchRequest, CacheRepository_FetchServer) error
+	Watch(*WatchRequest, CacheRepository_WatchServer) error
+	Summary(context.Context, *SummaryRequest) (*SummaryResponse, error)
+	Digest(context.Context, *DigestRequest) (*DigestResponse, error)
+	Tombstones(context.Context, *TombstonesRequest) (*TombstonesResponse, error)
+	Purge(context.Context, *PurgeRequest) (*PurgeResponse, error)
+	HandOff(context.Context, *HandOffRequest) (*HandOffResponse, error)
 	mustEmbedUnimplementedCacheRepositoryServer()
 }
 
@@ -61,6 +191,27 @@ type UnimplementedCacheRepositoryServer struct {
 func (UnimplementedCacheRepositoryServer) List(context.Context, *ListRequest) (*ListResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
 }
+func (UnimplementedCacheRepositoryServer) Fetch(*FetchRequest, CacheRepository_FetchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedCacheRepositoryServer) Watch(*WatchRequest, CacheRepository_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedCacheRepositoryServer) Summary(context.Context, *SummaryRequest) (*SummaryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Summary not implemented")
+}
+func (UnimplementedCacheRepositoryServer) Digest(context.Context, *DigestRequest) (*DigestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Digest not implemented")
+}
+func (UnimplementedCacheRepositoryServer) Tombstones(context.Context, *TombstonesRequest) (*TombstonesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Tombstones not implemented")
+}
+func (UnimplementedCacheRepositoryServer) Purge(context.Context, *PurgeRequest) (*PurgeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Purge not implemented")
+}
+func (UnimplementedCacheRepositoryServer) HandOff(context.Context, *HandOffRequest) (*HandOffResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HandOff not implemented")
+}
 func (UnimplementedCacheRepositoryServer) mustEmbedUnimplementedCacheRepositoryServer() {}
 
 // UnsafeCacheRepositoryServer may be embedded to opt out of forward compatibility for this service.
@@ -92,6 +243,138 @@ func _CacheRepository_List_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CacheRepository_Fetch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CacheRepositoryServer).Fetch(m, &cacheRepositoryFetchServer{stream})
+}
+
+type CacheRepository_FetchServer interface {
+	Send(*FetchResponse) error
+	grpc.ServerStream
+}
+
+type cacheRepositoryFetchServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheRepositoryFetchServer) Send(m *FetchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _CacheRepository_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CacheRepositoryServer).Watch(m, &cacheRepositoryWatchServer{stream})
+}
+
+type CacheRepository_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type cacheRepositoryWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheRepositoryWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _CacheRepository_Summary_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SummaryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheRepositoryServer).Summary(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CacheRepository_Summary_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheRepositoryServer).Summary(ctx, req.(*SummaryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CacheRepository_Digest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DigestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheRepositoryServer).Digest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CacheRepository_Digest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheRepositoryServer).Digest(ctx, req.(*DigestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CacheRepository_Tombstones_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TombstonesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheRepositoryServer).Tombstones(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CacheRepository_Tombstones_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheRepositoryServer).Tombstones(ctx, req.(*TombstonesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CacheRepository_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheRepositoryServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CacheRepository_Purge_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheRepositoryServer).Purge(ctx, req.(*PurgeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CacheRepository_HandOff_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HandOffRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheRepositoryServer).HandOff(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CacheRepository_HandOff_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheRepositoryServer).HandOff(ctx, req.(*HandOffRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CacheRepository_ServiceDesc is the grpc.ServiceDesc for CacheRepository service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -103,7 +386,38 @@ var CacheRepository_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "List",
 			Handler:    _CacheRepository_List_Handler,
 		},
+		{
+			MethodName: "Summary",
+			Handler:    _CacheRepository_Summary_Handler,
+		},
+		{
+			MethodName: "Digest",
+			Handler:    _CacheRepository_Digest_Handler,
+		},
+		{
+			MethodName: "Tombstones",
+			Handler:    _CacheRepository_Tombstones_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _CacheRepository_Purge_Handler,
+		},
+		{
+			MethodName: "HandOff",
+			Handler:    _CacheRepository_HandOff_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Fetch",
+			Handler:       _CacheRepository_Fetch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _CacheRepository_Watch_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "internal/nginx/cache_repository/v1/cache_repository.proto",
 }
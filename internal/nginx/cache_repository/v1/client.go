@@ -0,0 +1,97 @@
+package v1
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ReceiveFetch consumes a Fetch stream, writing the file contents into w. It
+// returns the header sent by the server once the whole file was received and
+// its size and checksum were verified.
+func ReceiveFetch(stream CacheRepository_FetchClient, w io.Writer) (*FetchHeader, error) {
+	r, err := NewFetchReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	return r.Header, nil
+}
+
+// FetchReader reads the file contents of a Fetch stream. The size and
+// checksum announced in the header are verified when the end of the stream
+// is reached, returning an error instead of io.EOF on mismatch.
+type FetchReader struct {
+	Header *FetchHeader
+
+	stream CacheRepository_FetchClient
+	chunk  []byte
+	hash   hash.Hash
+	size   int64
+	err    error
+}
+
+// NewFetchReader receives the header of a Fetch stream, returning a reader
+// of the contents that follow it.
+func NewFetchReader(stream CacheRepository_FetchClient) (*FetchReader, error) {
+	r, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	header := r.GetHeader()
+	if header == nil {
+		return nil, errors.New("first message of the stream is not a header")
+	}
+
+	return &FetchReader{Header: header, stream: stream, hash: sha256.New()}, nil
+}
+
+func (r *FetchReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		m, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			r.err = r.verify()
+			continue
+		}
+
+		if err != nil {
+			r.err = err
+			continue
+		}
+
+		r.chunk = m.GetChunk()
+		r.hash.Write(r.chunk)
+		r.size += int64(len(r.chunk))
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
+
+func (r *FetchReader) verify() error {
+	if r.size != r.Header.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, received %d", r.Header.Size, r.size)
+	}
+
+	if !bytes.Equal(r.hash.Sum(nil), r.Header.Checksum) {
+		return ErrChecksumMismatch
+	}
+
+	return io.EOF
+}
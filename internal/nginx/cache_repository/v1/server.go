@@ -2,24 +2,422 @@ package v1
 
 import (
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
 	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
 )
 
+const (
+	DefaultPageSize = 1000
+	MaxPageSize     = 10000
+
+	// FetchChunkSize is the maximum size of the chunks sent by Fetch.
+	FetchChunkSize = 64 * 1024
+
+	// DigestHeadroom is the minimum number of additions a digest can take
+	// before exceeding its false positive rate.
+	DigestHeadroom = 1024
+)
+
 var _ CacheRepositoryServer = (*Server)(nil)
 
+// PurgeFanOut sends purges to the peers of a node.
+type PurgeFanOut interface {
+	// PurgePeers sends req to every peer, returning their results.
+	PurgePeers(ctx context.Context, req *PurgeRequest) []*PeerPurge
+}
+
+// HandOffReceiver pulls the entries handed off by leaving peers.
+type HandOffReceiver interface {
+	// ReceiveHandOff pulls the entries of req from the caller, returning the
+	// IDs of those pulled.
+	ReceiveHandOff(ctx context.Context, req *HandOffRequest) ([]string, error)
+}
+
 type Server struct {
 	*UnimplementedCacheRepositoryServer
-	Cache  *cr.CacheWatcher
+	// Cache is the zone served to requests which do not name one.
+	Cache *cr.CacheWatcher
+	// Zones are the cache zones served, by namespace.
+	Zones  map[string]*cr.CacheWatcher
 	Logger *zap.Logger
+	// Peers receives the purges requested with fan_out; when nil, purges are
+	// local only.
+	Peers PurgeFanOut
+	// Receiver pulls the entries handed off by leaving peers; when nil, HandOff is
+	// unimplemented.
+	Receiver HandOffReceiver
+
+	digestMu sync.Mutex
+	digests  map[string]*digest // last digest built by zone, reused while the index is unchanged
+}
+
+type digest struct {
+	resp   *DigestResponse
+	fpRate float64
+}
+
+// cache returns the cache zone a request refers to.
+func (s *Server) cache(zone string) (*cr.CacheWatcher, error) {
+	if zone == "" && s.Cache != nil {
+		return s.Cache, nil
+	}
+
+	if cw, found := s.Zones[zone]; found {
+		return cw, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "cache zone %q not found", zone)
 }
 
 func (s *Server) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
-	s.Logger.Debug("List method called")
+	s.Logger.Debug("List method called", zap.String("zone", req.GetZone()), zap.Int32("page_size", req.GetPageSize()), zap.String("page_token", req.GetPageToken()))
 	defer s.Logger.Debug("List method finished")
 
-	return nil, fmt.Errorf("not implemented yet")
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+
+	entries, next := cache.List(req.GetPrefix(), req.GetPageToken(), pageSize)
+
+	items := make(map[string]*CacheItem, len(entries))
+	for _, ce := range entries {
+		items[ce.ID] = NewCacheItem(ce)
+	}
+
+	return &ListResponse{Items: items, NextPageToken: next}, nil
+}
+
+func (s *Server) Fetch(req *FetchRequest, stream CacheRepository_FetchServer) error {
+	s.Logger.Debug("Fetch method called", zap.String("zone", req.GetZone()), zap.String("id", req.GetId()))
+	defer s.Logger.Debug("Fetch method finished", zap.String("id", req.GetId()))
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return err
+	}
+
+	ce, found := cache.Get(req.GetId())
+	if !found || ce.Expired(time.Now()) {
+		return status.Errorf(codes.NotFound, "cache entry %q not found", req.GetId())
+	}
+
+	// NOTE: the same file descriptor is used to compute the checksum and to
+	// stream the contents, so a concurrent replacement by nginx (rename) cannot
+	// make them disagree.
+	f, err := os.Open(ce.Filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return status.Errorf(codes.NotFound, "cache entry %q not found", req.GetId())
+	}
+
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open cache entry: %s", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to stat cache entry: %s", err)
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return status.Errorf(codes.Internal, "failed to read cache entry: %s", err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return status.Errorf(codes.Internal, "failed to read cache entry: %s", err)
+	}
+
+	err = stream.Send(&FetchResponse{Payload: &FetchResponse_Header{Header: &FetchHeader{
+		Id:           ce.ID,
+		Size:         fi.Size(),
+		Modification: timestamppb.New(fi.ModTime()),
+		Checksum:     h.Sum(nil),
+	}}})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, FetchChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if serr := stream.Send(&FetchResponse{Payload: &FetchResponse_Chunk{Chunk: buf[:n]}}); serr != nil {
+				return serr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read cache entry: %s", err)
+		}
+	}
+}
+
+func (s *Server) Watch(req *WatchRequest, stream CacheRepository_WatchServer) error {
+	s.Logger.Debug("Watch method called", zap.String("zone", req.GetZone()), zap.Uint64("epoch", req.GetEpoch()), zap.Uint64("since_sequence", req.GetSinceSequence()))
+	defer s.Logger.Debug("Watch method finished")
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return err
+	}
+
+	epoch, seq := req.GetEpoch(), req.GetSinceSequence()
+	if epoch == 0 {
+		epoch, seq = cache.Head()
+	}
+
+	for {
+		events, changed, ok := cache.Events(epoch, seq)
+		if !ok {
+			return status.Errorf(codes.OutOfRange, "cannot resume from epoch %d and sequence %d", epoch, seq)
+		}
+
+		now := time.Now()
+
+		for _, evt := range events {
+			seq = evt.Sequence
+
+			if evt.Type == cr.EventAdded && evt.Entry.Expired(now) { // the removal follows
+				continue
+			}
+
+			if err := stream.Send(newWatchEvent(evt)); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) Summary(ctx context.Context, req *SummaryRequest) (*SummaryResponse, error) {
+	s.Logger.Debug("Summary method called", zap.String("zone", req.GetZone()), zap.String("prefix", req.GetPrefix()))
+	defer s.Logger.Debug("Summary method finished")
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return nil, err
+	}
+
+	node, ok := cache.Summary(req.GetPrefix())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid prefix %q", req.GetPrefix())
+	}
+
+	return &SummaryResponse{Node: newSummaryNode(node)}, nil
+}
+
+func (s *Server) Digest(ctx context.Context, req *DigestRequest) (*DigestResponse, error) {
+	s.Logger.Debug("Digest method called", zap.String("zone", req.GetZone()), zap.Float64("false_positive_rate", req.GetFalsePositiveRate()))
+	defer s.Logger.Debug("Digest method finished")
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return nil, err
+	}
+
+	fpRate := req.GetFalsePositiveRate()
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = bloom.DefaultFalsePositiveRate
+	}
+
+	// NOTE: the journal head is taken before the keys, so entries added
+	// meanwhile are in the filter or after the returned sequence (never lost).
+	epoch, seq := cache.Head()
+
+	s.digestMu.Lock()
+	defer s.digestMu.Unlock()
+
+	if d := s.digests[req.GetZone()]; d != nil && d.resp.Epoch == epoch && d.resp.Sequence == seq && d.fpRate == fpRate {
+		return d.resp, nil
+	}
+
+	now := time.Now()
+
+	var keys []string
+	for _, key := range cache.Keys() {
+		if ce, found := cache.Get(key); found && !ce.Expired(now) { // as in List
+			keys = append(keys, key)
+		}
+	}
+
+	// leaving room for the entries peers add to the filter through Watch
+	filter := bloom.New(len(keys)+len(keys)/4+DigestHeadroom, fpRate)
+	for _, key := range keys {
+		filter.Add(key)
+	}
+
+	b, err := filter.MarshalBinary()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode digest: %s", err)
+	}
+
+	if s.digests == nil {
+		s.digests = make(map[string]*digest)
+	}
+
+	resp := &DigestResponse{Filter: b, Epoch: epoch, Sequence: seq}
+	s.digests[req.GetZone()] = &digest{resp: resp, fpRate: fpRate}
+
+	return resp, nil
+}
+
+func (s *Server) Tombstones(ctx context.Context, req *TombstonesRequest) (*TombstonesResponse, error) {
+	s.Logger.Debug("Tombstones method called", zap.String("zone", req.GetZone()))
+	defer s.Logger.Debug("Tombstones method finished")
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TombstonesResponse{}
+	for _, ce := range cache.Tombstones() {
+		resp.Items = append(resp.Items, NewCacheItem(ce))
+	}
+
+	return resp, nil
+}
+
+func (s *Server) Purge(ctx context.Context, req *PurgeRequest) (*PurgeResponse, error) {
+	s.Logger.Debug("Purge method called", zap.String("zone", req.GetZone()), zap.Any("match", req.GetMatch()), zap.Bool("fan_out", req.GetFanOut()))
+	defer s.Logger.Debug("Purge method finished")
+
+	cache, err := s.cache(req.GetZone())
+	if err != nil {
+		return nil, err
+	}
+
+	var match cr.KeyMatcher
+	switch m := req.GetMatch().(type) {
+	case *PurgeRequest_Key:
+		match = cr.ExactKey(m.Key)
+
+	case *PurgeRequest_Prefix:
+		match = cr.KeyPrefix(m.Prefix)
+
+	case *PurgeRequest_Pattern:
+		if match, err = cr.KeyPattern(m.Pattern); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+	default:
+		return nil, status.Error(codes.InvalidArgument, "one of key, prefix or pattern is required")
+	}
+
+	purged, err := cache.Purge(match)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to purge cache entries (%d purged): %s", len(purged), err)
+	}
+
+	resp := &PurgeResponse{}
+	for _, ce := range purged {
+		resp.Items = append(resp.Items, NewCacheItem(ce))
+	}
+
+	if req.GetFanOut() && s.Peers != nil {
+		resp.Peers = s.Peers.PurgePeers(ctx, req)
+	}
+
+	return resp, nil
+}
+
+func (s *Server) HandOff(ctx context.Context, req *HandOffRequest) (*HandOffResponse, error) {
+	s.Logger.Debug("HandOff method called", zap.String("zone", req.GetZone()), zap.String("address", req.GetAddress()), zap.Int("items", len(req.GetItems())))
+	defer s.Logger.Debug("HandOff method finished")
+
+	if s.Receiver == nil {
+		return nil, status.Error(codes.Unimplemented, "hand-off is not supported")
+	}
+
+	if _, err := s.cache(req.GetZone()); err != nil {
+		return nil, err
+	}
+
+	if req.GetAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "address is required")
+	}
+
+	ids, err := s.Receiver.ReceiveHandOff(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HandOffResponse{Ids: ids}, nil
+}
+
+func newWatchEvent(evt cr.CacheEvent) *WatchEvent {
+	typ := WatchEvent_ADDED
+	switch evt.Type {
+	case cr.EventRemoved:
+		typ = WatchEvent_REMOVED
+
+	case cr.EventTombstoned:
+		typ = WatchEvent_TOMBSTONED
+	}
+
+	return &WatchEvent{
+		Epoch:    evt.Epoch,
+		Sequence: evt.Sequence,
+		Type:     typ,
+		Item:     NewCacheItem(evt.Entry),
+	}
+}
+
+// NewCacheItem converts a cache entry to its wire representation.
+func NewCacheItem(ce cr.CacheEntry) *CacheItem {
+	item := &CacheItem{
+		Id:           ce.ID,
+		Modification: timestamppb.New(ce.Modification),
+		Key:          ce.Key,
+		Valid:        timestamppb.New(ce.ValidSec),
+		Size:         ce.Size,
+	}
+
+	if !ce.RemovedAt.IsZero() {
+		item.RemovedAt = timestamppb.New(ce.RemovedAt)
+	}
+
+	return item
+}
+
+func newSummaryNode(n cr.SummaryNode) *SummaryNode {
+	node := &SummaryNode{Prefix: n.Prefix, Hash: n.Hash, Count: int64(n.Count)}
+	for _, child := range n.Children {
+		node.Children = append(node.Children, newSummaryNode(child))
+	}
+
+	return node
 }
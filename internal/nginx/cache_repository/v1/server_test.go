@@ -0,0 +1,494 @@
+package v1_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+func TestServer_List(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		writeCacheFile(t, dir, key, "body")
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 5 }, 5*time.Second, 10*time.Millisecond)
+
+	s := &Server{Cache: watcher, Logger: zap.NewNop()}
+
+	seen := make(map[string]struct{})
+
+	var token string
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+
+		r, err := s.List(ctx, &ListRequest{PageSize: 2, PageToken: token})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(r.Items), 2)
+
+		for id, item := range r.Items {
+			assert.Equal(t, id, item.Id)
+			assert.NotContains(t, seen, id)
+			seen[id] = struct{}{}
+		}
+
+		if token = r.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	assert.Len(t, seen, 5)
+}
+
+func TestServer_Zones(t *testing.T) {
+	api, static := t.TempDir(), t.TempDir()
+	writeCacheFile(t, api, "/api/users", "[]")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	zones := map[string]*cr.CacheWatcher{"api": {Directory: api}, "static": {Directory: static}}
+	for _, watcher := range zones {
+		go watcher.Watch(ctx)
+	}
+
+	require.Eventually(t, func() bool { return len(zones["api"].Keys()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	s := &Server{Zones: zones, Logger: zap.NewNop()}
+
+	r, err := s.List(ctx, &ListRequest{Zone: "api"})
+	require.NoError(t, err)
+	assert.Len(t, r.Items, 1)
+
+	r, err = s.List(ctx, &ListRequest{Zone: "static"})
+	require.NoError(t, err)
+	assert.Empty(t, r.Items)
+
+	// no default zone
+	_, err = s.List(ctx, &ListRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = s.Summary(ctx, &SummaryRequest{Zone: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_Fetch(t *testing.T) {
+	dir := t.TempDir()
+
+	body := strings.Repeat("0123456789", FetchChunkSize/4)
+	filename := writeCacheFile(t, dir, "/large", body)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	client := newClient(t, &Server{Cache: watcher, Logger: zap.NewNop()})
+
+	stream, err := client.Fetch(ctx, &FetchRequest{Id: filepath.Base(filename)})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	header, err := ReceiveFetch(stream, &buf)
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Base(filename), header.Id)
+	assert.Equal(t, int64(len(expected)), header.Size)
+	assert.Equal(t, expected, buf.Bytes())
+
+	stream, err = client.Fetch(ctx, &FetchRequest{Id: "00000000000000000000000000000000"})
+	require.NoError(t, err)
+
+	_, err = ReceiveFetch(stream, io.Discard)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_Watch(t *testing.T) {
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	client := newClient(t, &Server{Cache: watcher, Logger: zap.NewNop()})
+
+	epoch, seq := watcher.Head()
+
+	stream, err := client.Watch(ctx, &WatchRequest{Epoch: epoch, SinceSequence: seq})
+	require.NoError(t, err)
+
+	a := writeCacheFile(t, dir, "/a", "a")
+
+	evt, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_ADDED, evt.Type)
+	assert.Equal(t, filepath.Base(a), evt.Item.Id)
+	assert.Equal(t, "/a", evt.Item.Key)
+
+	first := evt.Sequence
+
+	require.NoError(t, os.Remove(a))
+
+	evt, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_REMOVED, evt.Type)
+	assert.Equal(t, filepath.Base(a), evt.Item.Id)
+	assert.Equal(t, first+1, evt.Sequence)
+
+	// resuming after the first event replays the removal
+	resumed, err := client.Watch(ctx, &WatchRequest{Epoch: evt.Epoch, SinceSequence: first})
+	require.NoError(t, err)
+
+	evt, err = resumed.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_REMOVED, evt.Type)
+	assert.Equal(t, first+1, evt.Sequence)
+
+	stale, err := client.Watch(ctx, &WatchRequest{Epoch: evt.Epoch + 1, SinceSequence: first})
+	require.NoError(t, err)
+
+	_, err = stale.Recv()
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestServer_Summary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var servers [2]*Server
+	for i := range servers {
+		dir := t.TempDir()
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			writeCacheFile(t, dir, key, "body")
+		}
+
+		watcher := &cr.CacheWatcher{Directory: dir}
+		go watcher.Watch(ctx)
+
+		require.Eventually(t, func() bool { return len(watcher.Keys()) == 5 }, 5*time.Second, 10*time.Millisecond)
+
+		servers[i] = &Server{Cache: watcher, Logger: zap.NewNop()}
+	}
+
+	root := func(s *Server) *SummaryNode {
+		r, err := s.Summary(ctx, &SummaryRequest{})
+		require.NoError(t, err)
+		return r.Node
+	}
+
+	assert.Equal(t, root(servers[0]).Hash, root(servers[1]).Hash)
+	assert.EqualValues(t, 5, root(servers[0]).Count)
+
+	id := filepath.Base(writeCacheFile(t, servers[1].Cache.Directory, "f", "body"))
+	require.Eventually(t, func() bool { return len(servers[1].Cache.Keys()) == 6 }, 5*time.Second, 10*time.Millisecond)
+
+	// descending only into the differing buckets leads to the new entry
+	var prefix string
+	for len(prefix) < cr.SummaryDepth {
+		a, err := servers[0].Summary(ctx, &SummaryRequest{Prefix: prefix})
+		require.NoError(t, err)
+		b, err := servers[1].Summary(ctx, &SummaryRequest{Prefix: prefix})
+		require.NoError(t, err)
+
+		require.NotEqual(t, a.Node.Hash, b.Node.Hash)
+
+		var differing []string
+		for i := range b.Node.Children {
+			if !bytes.Equal(a.Node.Children[i].Hash, b.Node.Children[i].Hash) {
+				differing = append(differing, b.Node.Children[i].Prefix)
+			}
+		}
+
+		require.Len(t, differing, 1)
+		prefix = differing[0]
+	}
+
+	assert.Equal(t, id[:cr.SummaryDepth], prefix)
+
+	r, err := servers[1].List(ctx, &ListRequest{Prefix: prefix})
+	require.NoError(t, err)
+	assert.Contains(t, r.Items, id)
+
+	_, err = servers[1].Summary(ctx, &SummaryRequest{Prefix: "xyz"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_Digest(t *testing.T) {
+	dir := t.TempDir()
+
+	var ids []string
+	for _, key := range []string{"a", "b", "c"} {
+		ids = append(ids, filepath.Base(writeCacheFile(t, dir, key, "body")))
+	}
+
+	soon := time.Now().Add(time.Second)
+	expired := filepath.Base(writeCacheFileValid(t, dir, "d", "body", soon))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(time.Until(soon)) // expired, yet still indexed until the next expire tick
+
+	s := &Server{Cache: watcher, Logger: zap.NewNop()}
+
+	r, err := s.Digest(ctx, &DigestRequest{FalsePositiveRate: 0.001})
+	require.NoError(t, err)
+
+	var filter bloom.Filter
+	require.NoError(t, filter.UnmarshalBinary(r.Filter))
+
+	for _, id := range ids {
+		assert.True(t, filter.Test(id))
+	}
+	assert.False(t, filter.Test("00000000000000000000000000000000"))
+	assert.False(t, filter.Test(expired), "hidden like from List and Watch")
+
+	epoch, seq := watcher.Head()
+	assert.Equal(t, epoch, r.Epoch)
+	assert.Equal(t, seq, r.Sequence)
+
+	// unchanged index, same digest
+	again, err := s.Digest(ctx, &DigestRequest{FalsePositiveRate: 0.001})
+	require.NoError(t, err)
+	assert.Same(t, r, again)
+}
+
+func TestServer_Expiry(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCacheFile(t, dir, "/fresh", "body")
+	expiring := filepath.Base(writeCacheFileValid(t, dir, "/expiring", "body", time.Now().Add(1500*time.Millisecond)))
+	writeCacheFileValid(t, dir, "/expired", "body", time.Now().Add(-time.Minute))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir, ExpireInterval: 50 * time.Millisecond}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	client := newClient(t, &Server{Cache: watcher, Logger: zap.NewNop()})
+
+	epoch, seq := watcher.Head()
+
+	stream, err := client.Watch(ctx, &WatchRequest{Epoch: epoch, SinceSequence: seq})
+	require.NoError(t, err)
+
+	evt, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_REMOVED, evt.Type)
+	assert.Equal(t, expiring, evt.Item.Id)
+
+	r, err := client.List(ctx, &ListRequest{})
+	require.NoError(t, err)
+	assert.Len(t, r.Items, 1)
+	assert.NotContains(t, r.Items, expiring)
+
+	fetch, err := client.Fetch(ctx, &FetchRequest{Id: expiring})
+	require.NoError(t, err)
+
+	_, err = ReceiveFetch(fetch, io.Discard)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_Tombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	purged := writeCacheFile(t, dir, "/purged", "body")
+	writeCacheFile(t, dir, "/kept", "body")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	client := newClient(t, &Server{Cache: watcher, Logger: zap.NewNop()})
+
+	epoch, seq := watcher.Head()
+
+	stream, err := client.Watch(ctx, &WatchRequest{Epoch: epoch, SinceSequence: seq})
+	require.NoError(t, err)
+
+	removedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	applied, err := watcher.Tombstone(cr.CacheEntry{ID: filepath.Base(purged), RemovedAt: removedAt})
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.NoFileExists(t, purged)
+	assert.True(t, watcher.Tombstoned(filepath.Base(purged)))
+
+	applied, err = watcher.Tombstone(cr.CacheEntry{ID: filepath.Base(purged), RemovedAt: removedAt})
+	require.NoError(t, err)
+	assert.False(t, applied, "known tombstones are not applied twice")
+
+	applied, err = watcher.Tombstone(cr.CacheEntry{ID: "0123456789abcdef0123456789abcdef", RemovedAt: time.Now().Add(-2 * cr.DefaultTombstoneTTL)})
+	require.NoError(t, err)
+	assert.False(t, applied, "expired tombstones are ignored")
+
+	evt, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_TOMBSTONED, evt.Type)
+	assert.Equal(t, filepath.Base(purged), evt.Item.Id)
+	assert.Equal(t, "/purged", evt.Item.Key)
+	assert.Equal(t, removedAt, evt.Item.RemovedAt.AsTime().Local())
+
+	evt, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, WatchEvent_REMOVED, evt.Type)
+	assert.Equal(t, filepath.Base(purged), evt.Item.Id)
+
+	r, err := client.Tombstones(ctx, &TombstonesRequest{})
+	require.NoError(t, err)
+	require.Len(t, r.Items, 1)
+	assert.Equal(t, filepath.Base(purged), r.Items[0].Id)
+
+	assert.Len(t, watcher.Keys(), 1)
+}
+
+func TestServer_Purge(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCacheFile(t, dir, "/images/a.png", "body")
+	writeCacheFile(t, dir, "/images/b.jpg", "body")
+	writeCacheFile(t, dir, "/styles/main.css", "body")
+	writeCacheFile(t, dir, "/index.html", "body")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	watcher := &cr.CacheWatcher{Directory: dir}
+	go watcher.Watch(ctx)
+
+	require.Eventually(t, func() bool { return len(watcher.Keys()) == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	peers := &fakeFanOut{}
+	client := newClient(t, &Server{Cache: watcher, Logger: zap.NewNop(), Peers: peers})
+
+	r, err := client.Purge(ctx, &PurgeRequest{Match: &PurgeRequest_Pattern{Pattern: "/images/*.png"}})
+	require.NoError(t, err)
+	require.Len(t, r.Items, 1)
+	assert.Equal(t, "/images/a.png", r.Items[0].Key)
+	assert.Empty(t, r.Peers)
+
+	r, err = client.Purge(ctx, &PurgeRequest{Match: &PurgeRequest_Prefix{Prefix: "/images/"}, FanOut: true})
+	require.NoError(t, err)
+	require.Len(t, r.Items, 1)
+	assert.Equal(t, "/images/b.jpg", r.Items[0].Key)
+	require.Len(t, r.Peers, 1)
+	assert.Equal(t, int64(2), r.Peers[0].Purged)
+
+	r, err = client.Purge(ctx, &PurgeRequest{Match: &PurgeRequest_Key{Key: "/index.html"}})
+	require.NoError(t, err)
+	require.Len(t, r.Items, 1)
+
+	assert.Equal(t, []string{"/styles/main.css"}, keys(watcher))
+	assert.Len(t, watcher.Tombstones(), 3)
+
+	_, err = client.Purge(ctx, &PurgeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Purge(ctx, &PurgeRequest{Match: &PurgeRequest_Pattern{Pattern: "/[a"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+type fakeFanOut struct{}
+
+func (*fakeFanOut) PurgePeers(_ context.Context, req *PurgeRequest) []*PeerPurge {
+	return []*PeerPurge{{Peer: "10.0.0.2:8000", Purged: 2}}
+}
+
+func keys(cw *cr.CacheWatcher) (keys []string) {
+	for _, id := range cw.Keys() {
+		ce, _ := cw.Get(id)
+		keys = append(keys, ce.Key)
+	}
+
+	return
+}
+
+func newClient(t *testing.T, s *Server) CacheRepositoryClient {
+	t.Helper()
+
+	l := bufconn.Listen(1024 * 1024)
+
+	gs := grpc.NewServer()
+	RegisterCacheRepositoryServer(gs, s)
+
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return NewCacheRepositoryClient(conn)
+}
+
+func writeCacheFile(t *testing.T, dir, key, body string) string {
+	t.Helper()
+
+	return writeCacheFileValid(t, dir, key, body, time.Now().Add(time.Hour))
+}
+
+func writeCacheFileValid(t *testing.T, dir, key, body string, valid time.Time) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, cr.EncodeHeader(&buf, cr.CacheEntry{Key: key, ValidSec: valid}))
+	buf.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+	buf.WriteString(body)
+
+	sum := md5.Sum([]byte(key))
+	filename := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	require.NoError(t, os.WriteFile(filename, buf.Bytes(), 0o644))
+
+	return filename
+}
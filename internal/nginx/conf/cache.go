@@ -0,0 +1,262 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+// DefaultCacheKey is the proxy_cache_key used by nginx when none is set.
+const DefaultCacheKey = "$scheme$proxy_host$request_uri"
+
+// CacheZone is a cache declared by a proxy_cache_path directive.
+type CacheZone struct {
+	Name         string // keys_zone name
+	Path         string
+	Levels       []int
+	KeysZoneSize int64
+	MaxSize      int64         // zero when unlimited
+	Inactive     time.Duration // entries not accessed for this long are removed
+	UseTempPath  bool
+	// Keys are the distinct proxy_cache_key values used along with the zone,
+	// sorted.
+	Keys []string
+}
+
+// CacheZones returns the cache zones of the http block, by name.
+func CacheZones(directives []Directive) (map[string]*CacheZone, error) {
+	zones := make(map[string]*CacheZone)
+	keys := make(map[string]map[string]struct{})
+
+	for _, http := range find(directives, "http") {
+		for _, d := range find(http.Block, "proxy_cache_path") {
+			zone, err := parseCachePath(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", d.File, d.Line, err)
+			}
+
+			if _, found := zones[zone.Name]; found {
+				return nil, fmt.Errorf("%s:%d: duplicate zone %q", d.File, d.Line, zone.Name)
+			}
+
+			zones[zone.Name] = zone
+		}
+
+		collectKeys(http.Block, "", DefaultCacheKey, keys)
+	}
+
+	for name, set := range keys {
+		zone, found := zones[name]
+		if !found {
+			continue // e.g. a zone set through a variable
+		}
+
+		for key := range set {
+			zone.Keys = append(zone.Keys, key)
+		}
+
+		sort.Strings(zone.Keys)
+	}
+
+	return zones, nil
+}
+
+// collectKeys walks the http, server, location (and if) blocks, inheriting
+// proxy_cache and proxy_cache_key as nginx does, recording which keys are
+// used with which zones.
+func collectKeys(block []Directive, zone, key string, keys map[string]map[string]struct{}) {
+	for _, d := range block {
+		switch {
+		case d.Name == "proxy_cache" && len(d.Args) == 1:
+			zone = d.Args[0]
+			if zone == "off" {
+				zone = ""
+			}
+
+		case d.Name == "proxy_cache_key" && len(d.Args) == 1:
+			key = d.Args[0]
+		}
+	}
+
+	if zone != "" && hasProxyPass(block) {
+		if keys[zone] == nil {
+			keys[zone] = make(map[string]struct{})
+		}
+		keys[zone][key] = struct{}{}
+	}
+
+	for _, d := range block {
+		switch d.Name {
+		case "server", "location", "if", "limit_except":
+			collectKeys(d.Block, zone, key, keys)
+		}
+	}
+}
+
+func hasProxyPass(block []Directive) bool {
+	for _, d := range block {
+		if d.Name == "proxy_pass" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCachePath(d Directive) (*CacheZone, error) {
+	if len(d.Args) < 2 {
+		return nil, fmt.Errorf("invalid number of arguments in %q directive", d.Name)
+	}
+
+	zone := &CacheZone{Path: strings.TrimSuffix(d.Args[0], "/"), UseTempPath: true}
+
+	for _, arg := range d.Args[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter %q", arg)
+		}
+
+		var err error
+		switch name {
+		case "levels":
+			zone.Levels, err = cr.ParseLevels(value)
+
+		case "keys_zone":
+			var size string
+			zone.Name, size, _ = strings.Cut(value, ":")
+			if size == "" {
+				err = fmt.Errorf("missing keys_zone size")
+				break
+			}
+			zone.KeysZoneSize, err = ParseSize(size)
+
+		case "max_size":
+			zone.MaxSize, err = ParseSize(value)
+
+		case "inactive":
+			zone.Inactive, err = ParseTime(value)
+
+		case "use_temp_path":
+			switch value {
+			case "on":
+				zone.UseTempPath = true
+			case "off":
+				zone.UseTempPath = false
+			default:
+				err = fmt.Errorf("must be either on or off")
+			}
+
+		default: // e.g. min_free, manager_*, loader_*, purger*
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+	}
+
+	if zone.Name == "" {
+		return nil, fmt.Errorf("missing keys_zone")
+	}
+
+	if zone.Inactive == 0 {
+		zone.Inactive = 10 * time.Minute
+	}
+
+	return zone, nil
+}
+
+// ParseSize parses nginx sizes, such as "512", "10k", "64m" or "1g".
+func ParseSize(s string) (int64, error) {
+	var unit int64 = 1
+
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			unit, s = 1<<10, s[:n-1]
+		case 'm', 'M':
+			unit, s = 1<<20, s[:n-1]
+		case 'g', 'G':
+			unit, s = 1<<30, s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size")
+	}
+
+	return n * unit, nil
+}
+
+var timeUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"M":  30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// ParseTime parses nginx time intervals, such as "30", "10m" or "1h 30m";
+// a number without unit means seconds.
+func ParseTime(s string) (time.Duration, error) {
+	var total time.Duration
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid time")
+	}
+
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+
+		if i == 0 {
+			return 0, fmt.Errorf("invalid time")
+		}
+
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time")
+		}
+
+		s = s[i:]
+
+		j := 0
+		for j < len(s) && s[j] != ' ' && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+
+		unit := time.Second
+		if j > 0 {
+			var ok bool
+			if unit, ok = timeUnits[s[:j]]; !ok {
+				return 0, fmt.Errorf("invalid time unit %q", s[:j])
+			}
+		}
+
+		total += time.Duration(n) * unit
+		s = strings.TrimLeft(s[j:], " ")
+	}
+
+	return total, nil
+}
+
+func find(directives []Directive, name string) (found []Directive) {
+	for _, d := range directives {
+		if d.Name == name {
+			found = append(found, d)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,118 @@
+package conf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/conf"
+)
+
+func TestCacheZones(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, filepath.Join(dir, "nginx.conf"), `
+user nginx;
+events { worker_connections 1024; }
+
+http {
+    # zones
+    proxy_cache_path /var/cache/nginx/api levels=1:2 keys_zone=api:10m max_size=1g inactive=1h use_temp_path=off;
+    proxy_cache_path "/var/cache/nginx/static/" keys_zone=static:64m;
+
+    proxy_cache_key '$uri$is_args$args';
+
+    include conf.d/*.conf;
+}
+`)
+
+	writeFile(t, filepath.Join(dir, "conf.d", "default.conf"), `
+server {
+    listen 8080;
+    proxy_cache api;
+
+    location /api/ {
+        proxy_cache_key "${scheme}://$host$request_uri";
+        proxy_pass http://api;
+    }
+
+    location /assets/ {
+        proxy_cache static;
+        proxy_pass http://assets;
+    }
+
+    location = /healthz { return 200 'WORKING; {}'; }
+}
+`)
+
+	directives, err := Parse(filepath.Join(dir, "nginx.conf"))
+	require.NoError(t, err)
+
+	zones, err := CacheZones(directives)
+	require.NoError(t, err)
+	require.Len(t, zones, 2)
+
+	assert.Equal(t, &CacheZone{
+		Name:         "api",
+		Path:         "/var/cache/nginx/api",
+		Levels:       []int{1, 2},
+		KeysZoneSize: 10 << 20,
+		MaxSize:      1 << 30,
+		Inactive:     time.Hour,
+		UseTempPath:  false,
+		Keys:         []string{"${scheme}://$host$request_uri"},
+	}, zones["api"])
+
+	assert.Equal(t, &CacheZone{
+		Name:         "static",
+		Path:         "/var/cache/nginx/static",
+		KeysZoneSize: 64 << 20,
+		Inactive:     10 * time.Minute,
+		UseTempPath:  true,
+		Keys:         []string{"$uri$is_args$args"},
+	}, zones["static"])
+}
+
+func TestParse_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, filepath.Join(dir, "unbalanced.conf"), "http { server { listen 80; }")
+	_, err := Parse(filepath.Join(dir, "unbalanced.conf"))
+	assert.Error(t, err)
+
+	writeFile(t, filepath.Join(dir, "missing.conf"), "include other.conf;")
+	_, err = Parse(filepath.Join(dir, "missing.conf"))
+	assert.Error(t, err)
+
+	writeFile(t, filepath.Join(dir, "loop.conf"), "include loop.conf;")
+	_, err = Parse(filepath.Join(dir, "loop.conf"))
+	assert.ErrorContains(t, err, "too many nested includes")
+}
+
+func TestParseTime(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"30":     30 * time.Second,
+		"10m":    10 * time.Minute,
+		"1h 30m": 90 * time.Minute,
+		"1d12h":  36 * time.Hour,
+		"500ms":  500 * time.Millisecond,
+	} {
+		d, err := ParseTime(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, d, s)
+	}
+
+	_, err := ParseTime("10x")
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0o755))
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o644))
+}
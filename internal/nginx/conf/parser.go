@@ -0,0 +1,271 @@
+package conf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directive is a simple or block directive of an nginx configuration file.
+type Directive struct {
+	Name  string
+	Args  []string
+	Block []Directive // nil for simple directives
+	File  string
+	Line  int
+}
+
+// maxIncludeDepth guards against include loops.
+const maxIncludeDepth = 32
+
+var errUnexpectedEOF = errors.New("unexpected end of file")
+
+// Parse reads the nginx configuration file, replacing the include directives
+// by the directives of the files they refer to. Relative include paths are
+// resolved against the directory of filename, as nginx does with its prefix.
+func Parse(filename string) ([]Directive, error) {
+	p := &parser{root: filepath.Dir(filename)}
+	return p.parseFile(filename, 0)
+}
+
+type parser struct {
+	root string
+}
+
+func (p *parser) parseFile(filename string, depth int) ([]Directive, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: too many nested includes", filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lexer{data: data, line: 1}
+
+	directives, err := p.parseBlock(l, filename, depth, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %w", filename, l.line, err)
+	}
+
+	return directives, nil
+}
+
+func (p *parser) parseBlock(l *lexer, filename string, depth int, nested bool) ([]Directive, error) {
+	directives := []Directive{}
+
+	for {
+		tok, err := l.next()
+		if errors.Is(err, errUnexpectedEOF) && !nested {
+			return directives, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.special {
+			if tok.value == "}" && nested {
+				return directives, nil
+			}
+
+			return nil, fmt.Errorf("unexpected %q", tok.value)
+		}
+
+		d := Directive{Name: tok.value, File: filename, Line: tok.line}
+
+		for {
+			tok, err = l.next()
+			if err != nil {
+				return nil, err
+			}
+
+			if !tok.special {
+				d.Args = append(d.Args, tok.value)
+				continue
+			}
+
+			break
+		}
+
+		switch tok.value {
+		case ";":
+			if d.Name != "include" {
+				directives = append(directives, d)
+				continue
+			}
+
+			included, err := p.include(d, depth)
+			if err != nil {
+				return nil, err
+			}
+
+			directives = append(directives, included...)
+
+		case "{":
+			if d.Block, err = p.parseBlock(l, filename, depth, true); err != nil {
+				return nil, err
+			}
+
+			directives = append(directives, d)
+
+		default:
+			return nil, fmt.Errorf("unexpected %q", tok.value)
+		}
+	}
+}
+
+func (p *parser) include(d Directive, depth int) ([]Directive, error) {
+	if len(d.Args) != 1 {
+		return nil, errors.New("invalid number of arguments in \"include\" directive")
+	}
+
+	pattern := d.Args[0]
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.root, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("included file %q not found", pattern)
+	}
+
+	var directives []Directive
+	for _, match := range matches { // sorted, as nginx does
+		included, err := p.parseFile(match, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		directives = append(directives, included...)
+	}
+
+	return directives, nil
+}
+
+type token struct {
+	value   string
+	line    int
+	special bool // one of ";", "{" or "}"
+}
+
+type lexer struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpaceAndComments()
+
+	if l.pos >= len(l.data) {
+		return token{}, errUnexpectedEOF
+	}
+
+	line := l.line
+
+	switch c := l.data[l.pos]; c {
+	case ';', '{', '}':
+		l.pos++
+		return token{value: string(c), line: line, special: true}, nil
+
+	case '"', '\'':
+		l.pos++
+
+		var buf bytes.Buffer
+		for l.pos < len(l.data) {
+			ch := l.data[l.pos]
+			l.pos++
+
+			switch {
+			case ch == c:
+				return token{value: buf.String(), line: line}, nil
+
+			case ch == '\\' && l.pos < len(l.data):
+				next := l.data[l.pos]
+				l.pos++
+
+				switch next {
+				case c, '\\':
+					buf.WriteByte(next)
+				case 'n':
+					buf.WriteByte('\n')
+				case 't':
+					buf.WriteByte('\t')
+				case 'r':
+					buf.WriteByte('\r')
+				default:
+					buf.WriteByte('\\')
+					buf.WriteByte(next)
+				}
+
+			default:
+				if ch == '\n' {
+					l.line++
+				}
+				buf.WriteByte(ch)
+			}
+		}
+
+		return token{}, errUnexpectedEOF
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) {
+		ch := l.data[l.pos]
+
+		if ch == '$' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '{' { // ${variable}
+			end := bytes.IndexByte(l.data[l.pos:], '}')
+			if end < 0 {
+				return token{}, errUnexpectedEOF
+			}
+			l.pos += end + 1
+			continue
+		}
+
+		if isSpace(ch) || ch == ';' || ch == '{' || ch == '}' {
+			break
+		}
+
+		if ch == '\\' && l.pos+1 < len(l.data) {
+			l.pos++
+		}
+
+		l.pos++
+	}
+
+	return token{value: string(l.data[start:l.pos]), line: line}, nil
+}
+
+func (l *lexer) skipSpaceAndComments() {
+	for l.pos < len(l.data) {
+		switch ch := l.data[l.pos]; {
+		case ch == '\n':
+			l.line++
+			l.pos++
+
+		case isSpace(ch):
+			l.pos++
+
+		case ch == '#':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' {
+				l.pos++
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n'
+}
@@ -0,0 +1,94 @@
+package nginx_test
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_DiffCalls(t *testing.T) {
+	const entries = 2500 // three pages
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+	shared := t.TempDir()
+	for i := 0; i < entries; i++ {
+		key := fmt.Sprintf("/%d", i)
+		writeCacheFile(t, remote.Directory, key, "HTTP/1.1 200 OK\r\n\r\n", "body")
+		writeCacheFile(t, shared, key, "HTTP/1.1 200 OK\r\n\r\n", "body")
+	}
+
+	writeCacheFile(t, remote.Directory, "/new-1", "HTTP/1.1 200 OK\r\n\r\n", "body")
+	writeCacheFile(t, remote.Directory, "/new-3", "HTTP/1.1 200 OK\r\n\r\n", "body")
+
+	go remote.Watch(ctx)
+	require.Eventually(t, func() bool { return len(remote.Keys()) == entries+2 }, 10*time.Second, 10*time.Millisecond)
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote}}, grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		mu.Lock()
+		calls[path.Base(info.FullMethod)]++
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+
+	for _, tt := range []struct {
+		name          string
+		dir           string
+		local         int
+		summary, list int
+	}{
+		// listing the whole zone takes fewer calls than its 16 buckets
+		{name: "empty", dir: t.TempDir(), local: 0, summary: 1, list: 3},
+		// both missing entries are within distinct small buckets, each listed at once
+		{name: "nearly synced", dir: shared, local: entries, summary: 1, list: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			local := &cr.CacheWatcher{Directory: tt.dir}
+			go local.Watch(ctx)
+			require.Eventually(t, func() bool { return len(local.Keys()) == tt.local }, 10*time.Second, 10*time.Millisecond)
+
+			mu.Lock()
+			calls = make(map[string]int)
+			mu.Unlock()
+
+			cm := &CacheManager{
+				Discoverer:    &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+				Zones:         []*Zone{{Name: "static", Watcher: local, Replication: ReplicateAll}},
+				Interval:      time.Hour,
+				Logger:        zap.NewNop(),
+				WarmUpTimeout: 5 * time.Second,
+				WarmUpBytes:   1, // comparing once, fetching nothing
+			}
+
+			go cm.Reconcile(ctx)
+			require.Eventually(t, func() bool { return cm.WarmUp().Done }, 10*time.Second, 10*time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			assert.Equal(t, tt.summary, calls["Summary"])
+			assert.Equal(t, tt.list, calls["List"])
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package nginx
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+// digestMaxRemovals is the fraction of a digest's capacity that may be
+// removed on the peer before the digest is rebuilt.
+const digestMaxRemovals = 10 // i.e. 1/10
+
+// peerDigest is the Bloom filter of the cache entries of a peer. Entries
+// announced through Watch are added to it; since removals cannot be undone in
+// a Bloom filter, it is rebuilt once they pile up, or once Watch tells that
+// the peer restarted since it was built.
+type peerDigest struct {
+	mu         sync.RWMutex
+	filter     *bloom.Filter
+	epoch, seq uint64 // position of the peer's event journal the filter was built at
+	removed    int
+	refreshing atomic.Bool
+}
+
+func (d *peerDigest) test(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.filter != nil && d.filter.Test(id)
+}
+
+func (d *peerDigest) add(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filter != nil {
+		d.filter.Add(id)
+	}
+}
+
+func (d *peerDigest) remove() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.removed++
+}
+
+// observe drops the digest when a Watch event comes from another epoch of the
+// peer's event journal than the digest, i.e. the peer restarted meanwhile and
+// the entries it had are unknown. It reports whether the event happened after
+// the digest was built.
+func (d *peerDigest) observe(epoch, seq uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filter != nil && d.epoch != epoch {
+		d.filter = nil
+	}
+
+	return d.filter == nil || seq > d.seq
+}
+
+// invalidate makes the digest be rebuilt, e.g. after missing events.
+func (d *peerDigest) invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.filter = nil
+}
+
+// stale reports whether the digest is missing or too far from the peer's
+// actual inventory.
+func (d *peerDigest) stale() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.filter == nil {
+		return true
+	}
+
+	return d.filter.Count() > d.filter.Capacity() || d.removed > d.filter.Capacity()/digestMaxRemovals
+}
+
+// Lookup returns the peers which probably hold the cache entry id of zone,
+// according to their digests. False positives happen at about the configured
+// rate.
+func (cm *CacheManager) Lookup(zone, id string) (peers []sd.Peer) {
+	z, ok := cm.Zone(zone)
+	if !ok {
+		return nil
+	}
+
+	cm.peers.Range(func(_, value any) bool {
+		if pc := value.(*peerConn); pc.digests[z.Name].test(id) {
+			peers = append(peers, pc.peer)
+		}
+		return true
+	})
+
+	return
+}
+
+// digestOf returns the digest of a peer zone; a detached one when the peer is
+// gone.
+func (cm *CacheManager) digestOf(peer string, z *Zone) *peerDigest {
+	if value, ok := cm.peers.Load(peer); ok {
+		return value.(*peerConn).digests[z.Name]
+	}
+
+	return &peerDigest{}
+}
+
+// refreshDigests rebuilds the stale digests of all peers.
+func (cm *CacheManager) refreshDigests(ctx context.Context) {
+	cm.peers.Range(func(key, value any) bool {
+		pc := value.(*peerConn)
+		for _, z := range cm.Zones {
+			if d := pc.digests[z.Name]; d.stale() {
+				cm.refreshDigest(ctx, z, key.(string), pc.conn, d)
+			}
+		}
+		return true
+	})
+}
+
+// refreshDigest downloads the digest of a peer zone unless it is already
+// being downloaded.
+func (cm *CacheManager) refreshDigest(ctx context.Context, z *Zone, peer string, conn *grpc.ClientConn, d *peerDigest) {
+	if !d.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	defer d.refreshing.Store(false)
+
+	r, err := crv1.NewCacheRepositoryClient(conn).Digest(ctx, &crv1.DigestRequest{Zone: z.namespace(), FalsePositiveRate: cm.DigestFalsePositiveRate})
+	if ctx.Err() != nil { // peer is gone
+		return
+	}
+
+	if err != nil {
+		cm.Logger.Error("Failed to get peer digest", zap.String("peer", peer), zap.String("zone", z.Name), zap.Error(err))
+		return
+	}
+
+	filter := new(bloom.Filter)
+	if err = filter.UnmarshalBinary(r.Filter); err != nil {
+		cm.Logger.Error("Failed to decode peer digest", zap.String("peer", peer), zap.String("zone", z.Name), zap.Error(err))
+		return
+	}
+
+	entries := filter.Count() // the filter is updated by Watch once stored
+
+	d.mu.Lock()
+	d.filter, d.epoch, d.seq, d.removed = filter, r.Epoch, r.Sequence, 0
+	d.mu.Unlock()
+
+	cm.Logger.Debug("Refreshed peer digest", zap.String("peer", peer), zap.String("zone", z.Name), zap.Int("entries", entries), zap.Uint64("epoch", r.Epoch), zap.Uint64("sequence", r.Sequence))
+}
@@ -0,0 +1,66 @@
+package nginx_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_Lookup_PeerRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	// serve runs the peer on address, watching its cache, until stopped
+	serve := func(address string, watcher *cr.CacheWatcher) (string, func()) {
+		t.Helper()
+
+		wctx, wcancel := context.WithCancel(ctx)
+		go watcher.Watch(wctx)
+
+		peer, stop := serveTestPeer(t, address, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": watcher}})
+
+		return peer.ID(), func() { stop(); wcancel() }
+	}
+
+	dir := t.TempDir()
+	old := writeCacheFile(t, dir, "/old", "HTTP/1.1 200 OK\r\n\r\n", "old")
+
+	address, stop := serve("127.0.0.1:0", &cr.CacheWatcher{Directory: dir})
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{parsePeer(t, address)}},
+		Zones:      []*Zone{{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}, Replication: ReplicateNone}},
+		Interval:   time.Hour,
+		Logger:     zap.NewNop(),
+	}
+	go cm.Reconcile(ctx)
+
+	require.Eventually(t, func() bool { return len(cm.Lookup("static", old)) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the peer restarts having lost its entries; no event was received before,
+	// so the watch resumes from the new journal without noticing
+	stop()
+
+	restarted := &cr.CacheWatcher{Directory: t.TempDir()}
+	_, stop = serve(address, restarted)
+	defer stop()
+
+	require.Eventually(t, func() bool { return restarted.Synced() }, 5*time.Second, 10*time.Millisecond)
+
+	// entries keep being added until the watch is back
+	var added []string
+	require.Eventually(t, func() bool {
+		added = append(added, writeCacheFile(t, restarted.Directory, fmt.Sprintf("/new-%d", len(added)), "HTTP/1.1 200 OK\r\n\r\n", "new"))
+
+		return len(cm.Lookup("static", added[0])) == 1 && len(cm.Lookup("static", old)) == 0
+	}, 15*time.Second, 100*time.Millisecond)
+}
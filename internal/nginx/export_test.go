@@ -0,0 +1,28 @@
+package nginx
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+var (
+	ErrKeyMismatch = errKeyMismatch
+	MkdirAllAs     = mkdirAllAs
+)
+
+func (cm *CacheManager) Fetch(ctx context.Context, z *Zone, conn *grpc.ClientConn, id string) (int64, error) {
+	return cm.fetch(ctx, z, conn, id)
+}
+
+func (cm *CacheManager) Fresh(item *crv1.CacheItem) bool { return cm.fresh(item) }
+
+func (cm *CacheManager) Pull(ctx context.Context, z *Zone, conn *grpc.ClientConn, item *crv1.CacheItem) bool {
+	return cm.pull(ctx, z, "", conn, item, &cm.budget)
+}
+
+func (cm *CacheManager) Replicate(ctx context.Context) { cm.replicate(ctx) }
+
+func (cm *CacheManager) Budget() int64 { return cm.budget.Load() }
@@ -0,0 +1,198 @@
+package nginx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+const (
+	DefaultCacheKeyHeader  = "X-Cache-Key"
+	DefaultCacheZoneHeader = "X-Cache-Zone"
+
+	// maxFallbackAttempts limits how many peers are tried for a single
+	// request, since digests may report false positives.
+	maxFallbackAttempts = 3
+)
+
+var errFallbackMiss = errors.New("cache entry not available on peer")
+
+// hopByHopHeaders are not forwarded from the stored response.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// FallbackHandler serves, over HTTP, cache entries held by peers. It is meant
+// to be an nginx upstream tried on cache misses: the request carries the
+// cache key (as computed by proxy_cache_key) in the KeyHeader header, and the
+// zone name in the ZoneHeader one (optional with a single zone). The response
+// is the one stored by the peer, with its original status and headers. It
+// responds 404 when no peer has the entry.
+type FallbackHandler struct {
+	Manager    *CacheManager
+	KeyHeader  string
+	ZoneHeader string
+	Logger     *zap.Logger
+}
+
+func (h *FallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyHeader := h.KeyHeader
+	if keyHeader == "" {
+		keyHeader = DefaultCacheKeyHeader
+	}
+
+	key := r.Header.Get(keyHeader)
+	if key == "" {
+		http.Error(w, fmt.Sprintf("missing %s header", keyHeader), http.StatusBadRequest)
+		return
+	}
+
+	zoneHeader := h.ZoneHeader
+	if zoneHeader == "" {
+		zoneHeader = DefaultCacheZoneHeader
+	}
+
+	z, ok := h.Manager.Zone(r.Header.Get(zoneHeader))
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cache zone %q", r.Header.Get(zoneHeader)), http.StatusBadRequest)
+		return
+	}
+
+	sum := md5.Sum([]byte(key))
+	id := hex.EncodeToString(sum[:])
+
+	for i, pc := range h.Manager.holders(z, id) {
+		if i == maxFallbackAttempts {
+			break
+		}
+
+		err := h.serve(r.Context(), w, z, pc, id, key)
+		if err == nil {
+			metrics.FallbackRequests.WithLabelValues(z.Name, "hit").Inc()
+			return
+		}
+
+		if !errors.Is(err, errFallbackMiss) {
+			h.Logger.Error("Failed to serve cache entry from peer", zap.String("peer", pc.peer.ID()), zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	metrics.FallbackRequests.WithLabelValues(z.Name, "miss").Inc()
+	http.NotFound(w, r)
+}
+
+// serve streams the entry from a peer. Errors before the response is started
+// let the caller try another peer; afterwards, the response is aborted so
+// nginx never caches a truncated body.
+func (h *FallbackHandler) serve(ctx context.Context, w http.ResponseWriter, z *Zone, pc *peerConn, id, key string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := crv1.NewCacheRepositoryClient(pc.conn).Fetch(ctx, &crv1.FetchRequest{Zone: z.namespace(), Id: id})
+	if err != nil {
+		return err
+	}
+
+	fr, err := crv1.NewFetchReader(stream)
+	if status.Code(err) == codes.NotFound {
+		return errFallbackMiss
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var ce cr.CacheEntry
+	if err = cr.DecodeHeader(fr, &ce); err != nil {
+		return err
+	}
+
+	if ce.Key != key {
+		return fmt.Errorf("cache key %q does not match the requested one", ce.Key)
+	}
+
+	if ce.Expired(time.Now()) {
+		return errFallbackMiss
+	}
+
+	headers := make([]byte, int(ce.BodyStart)-int(ce.HeaderStart))
+	if _, err = io.ReadFull(fr, headers); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(headers)), nil)
+	if err != nil {
+		return fmt.Errorf("failed to parse stored response headers: %w", err)
+	}
+
+	for _, name := range hopByHopHeaders {
+		resp.Header.Del(name)
+	}
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(fr.Header.Size-int64(ce.BodyStart), 10))
+	w.Header().Set("X-Cache-Peer", pc.peer.ID())
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err = io.Copy(w, fr); err != nil {
+		h.Logger.Error("Failed to stream cache entry from peer", zap.String("peer", pc.peer.ID()), zap.String("id", id), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+// holders returns the peers which probably hold the cache entry id of a
+// zone, owners of the entry first.
+func (cm *CacheManager) holders(z *Zone, id string) (peers []*peerConn) {
+	var others []*peerConn
+
+	owners := cm.owners(z, id)
+
+	cm.peers.Range(func(_, value any) bool {
+		pc := value.(*peerConn)
+		if !pc.digests[z.Name].test(id) {
+			return true
+		}
+
+		if contains(owners, pc.node) {
+			peers = append(peers, pc)
+		} else {
+			others = append(others, pc)
+		}
+
+		return true
+	})
+
+	return append(peers, others...)
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+
+	return false
+}
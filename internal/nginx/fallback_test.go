@@ -0,0 +1,115 @@
+package nginx_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestFallbackHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	// a peer holding the entry in one of its zones
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+	go remote.Watch(ctx)
+
+	other := &cr.CacheWatcher{Directory: t.TempDir()}
+	go other.Watch(ctx)
+
+	id := writeCacheFile(t, remote.Directory, "/greeting?name=nginx", "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\nX-Origin: upstream\r\n\r\n", "Hello world, nginx")
+	require.Eventually(t, func() bool { return len(remote.Keys()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote, "api": other}})
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+		Zones: []*Zone{
+			{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}, Replication: ReplicateNone},
+			{Name: "api", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}, Replication: ReplicateNone},
+		},
+		Interval: time.Hour,
+	}
+	go cm.Reconcile(ctx)
+
+	require.Eventually(t, func() bool { return len(cm.Lookup("static", id)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, cm.Lookup("api", id))
+
+	h := &FallbackHandler{Manager: cm, Logger: zap.NewNop()}
+
+	req := httptest.NewRequest(http.MethodGet, "/greeting?name=nginx", nil)
+	req.Header.Set(DefaultCacheKeyHeader, "/greeting?name=nginx")
+	req.Header.Set(DefaultCacheZoneHeader, "static")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello world, nginx", w.Body.String())
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	assert.Equal(t, "upstream", w.Header().Get("X-Origin"))
+	assert.Empty(t, w.Header().Get("Connection"))
+	assert.Equal(t, peer.ID(), w.Header().Get("X-Cache-Peer"))
+
+	req.Header.Set(DefaultCacheZoneHeader, "api")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req.Header.Set(DefaultCacheZoneHeader, "static")
+
+	req.Header.Set(DefaultCacheKeyHeader, "/unknown")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("X-Cache-Peer"))
+
+	req.Header.Del(DefaultCacheKeyHeader)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func writeCacheFile(t *testing.T, dir, key, headers, body string) string {
+	t.Helper()
+
+	ce := cr.CacheEntry{Key: key, ValidSec: time.Now().Add(time.Hour)}
+
+	var buf bytes.Buffer
+	require.NoError(t, cr.EncodeHeader(&buf, ce))
+
+	ce.BodyStart = uint16(buf.Len() + len(headers))
+
+	buf.Reset()
+	require.NoError(t, cr.EncodeHeader(&buf, ce))
+	buf.WriteString(headers)
+	buf.WriteString(body)
+
+	sum := md5.Sum([]byte(key))
+	id := hex.EncodeToString(sum[:])
+	require.NoError(t, os.WriteFile(filepath.Join(dir, id), buf.Bytes(), 0o644))
+
+	return id
+}
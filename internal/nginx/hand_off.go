@@ -0,0 +1,264 @@
+package nginx
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/ring"
+)
+
+const (
+	DefaultHandOffTimeout = 20 * time.Second
+
+	// handOffBatchSize is the number of entries handed off on each request.
+	handOffBatchSize = 100
+)
+
+var _ crv1.HandOffReceiver = (*CacheManager)(nil)
+
+// HandOff makes the remaining peers pull the cache entries only this node
+// holds (as far as their digests tell) before it leaves, the most recently
+// modified first. Each entry goes to its primary owner among the remaining
+// peers, the other owners replicating it from there as usual. It returns the
+// number of entries handed off once done or ctx is done, and must be called
+// while this node still serves Fetch.
+func (cm *CacheManager) HandOff(ctx context.Context) int64 {
+	start := time.Now()
+
+	ctx, span := tracer.Start(ctx, "hand-off")
+	defer span.End()
+
+	peers := make(map[string]*peerConn) // by canonical address
+	cm.peers.Range(func(_, value any) bool {
+		pc := value.(*peerConn)
+		peers[pc.node] = pc
+		return true
+	})
+
+	if cm.self == "" || len(peers) == 0 {
+		cm.Logger.Info("Skipping cache hand-off", zap.Int("peers", len(peers)))
+		return 0
+	}
+
+	nodes := make([]string, 0, len(peers))
+	for address := range peers {
+		nodes = append(nodes, address)
+	}
+
+	r := ring.New(cm.VirtualNodes, nodes...)
+
+	var (
+		planned int
+		handed  atomic.Int64
+		wg      sync.WaitGroup
+	)
+
+	for _, z := range cm.Zones {
+		if z.Replication == ReplicateNone {
+			continue
+		}
+
+		batches := make(map[string][]*crv1.CacheItem) // by owner canonical address
+		for _, id := range z.Watcher.Keys() {
+			ce, found := z.Watcher.Get(id)
+			if !found {
+				continue
+			}
+
+			if item := crv1.NewCacheItem(ce); cm.fresh(item) && !cm.heldByPeers(z, id) {
+				owner := r.Owners(id, 1)[0]
+				batches[owner] = append(batches[owner], item)
+			}
+		}
+
+		for address, items := range batches {
+			sort.Slice(items, func(i, j int) bool {
+				return items[i].Modification.AsTime().After(items[j].Modification.AsTime())
+			})
+
+			planned += len(items)
+
+			z, pc, items := z, peers[address], items
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handed.Add(cm.handOff(ctx, z, pc, items))
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	span.SetAttributes(attribute.Int("planned", planned), attribute.Int64("handed", handed.Load()))
+
+	cm.Logger.Info("Cache hand-off finished", zap.Int("planned", planned), zap.Int64("handed", handed.Load()), zap.Bool("timed_out", ctx.Err() != nil), zap.Duration("elapsed", time.Since(start)))
+
+	return handed.Load()
+}
+
+// heldByPeers reports whether some peer probably holds the cache entry id of
+// a zone, according to its digest.
+func (cm *CacheManager) heldByPeers(z *Zone, id string) (held bool) {
+	cm.peers.Range(func(_, value any) bool {
+		held = value.(*peerConn).digests[z.Name].test(id)
+		return !held
+	})
+
+	return
+}
+
+// handOff sends the entries of a zone to a peer in batches, returning how
+// many it pulled.
+func (cm *CacheManager) handOff(ctx context.Context, z *Zone, pc *peerConn, items []*crv1.CacheItem) (handed int64) {
+	client := crv1.NewCacheRepositoryClient(pc.conn)
+
+	for len(items) > 0 && ctx.Err() == nil {
+		n := handOffBatchSize
+		if n > len(items) {
+			n = len(items)
+		}
+
+		resp, err := client.HandOff(ctx, &crv1.HandOffRequest{Zone: z.namespace(), Address: cm.Self, Items: items[:n]})
+		items = items[n:]
+
+		if err != nil {
+			cm.Logger.Error("Failed to hand off cache entries", zap.String("peer", pc.peer.ID()), zap.String("zone", z.Name), zap.Int("items", n), zap.Error(err))
+
+			if status.Code(err) == codes.Unimplemented {
+				return
+			}
+
+			continue
+		}
+
+		handed += int64(len(resp.Ids))
+	}
+
+	return
+}
+
+// ReceiveHandOff pulls the entries handed off by a leaving peer, within the
+// byte budget of the replication cycles. Only the entries this node is going
+// to own once the peer is gone are pulled, and only from discovered peers the
+// request comes from.
+func (cm *CacheManager) ReceiveHandOff(ctx context.Context, req *crv1.HandOffRequest) ([]string, error) {
+	z, ok := cm.zoneOf(req.GetZone())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "cache zone %q not found", req.GetZone())
+	}
+
+	if z.Replication == ReplicateNone {
+		return nil, nil
+	}
+
+	pc, err := cm.handOffPeer(ctx, req.GetAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	peer := pc.node
+
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+
+	eg, egctx := errgroup.WithContext(ctx)
+	eg.SetLimit(cm.MaxConcurrentFetches)
+
+	for _, item := range req.GetItems() {
+		item := item
+		eg.Go(func() error {
+			if cm.takesOver(z, item.Id, peer) && cm.transfer(egctx, z, peer, pc.conn, item, &cm.budget) {
+				mu.Lock()
+				ids = append(ids, item.Id)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	eg.Wait()
+
+	cm.Logger.Info("Received cache hand-off", zap.String("peer", peer), zap.String("zone", z.Name), zap.Int("items", len(req.GetItems())), zap.Int("pulled", len(ids)))
+
+	return ids, nil
+}
+
+// handOffPeer returns the discovered peer at address, as long as the caller of
+// ctx connects from one of its IP addresses.
+func (cm *CacheManager) handOffPeer(ctx context.Context, address string) (*peerConn, error) {
+	node := cm.canonicalAddress(ctx, address)
+
+	var pc *peerConn
+	cm.peers.Range(func(_, value any) bool {
+		if p := value.(*peerConn); p.node == node {
+			pc = p
+		}
+		return pc == nil
+	})
+
+	if pc == nil {
+		return nil, status.Errorf(codes.PermissionDenied, "peer %q not discovered", address)
+	}
+
+	caller, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "unknown caller")
+	}
+
+	host, _, err := net.SplitHostPort(caller.Addr.String())
+	if err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "unknown caller address %q", caller.Addr)
+	}
+
+	ips, err := cm.resolver().LookupHost(ctx, pc.peer.Host)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to resolve peer %q: %s", address, err)
+	}
+
+	callerIP := net.ParseIP(host)
+	for _, ip := range ips {
+		if net.ParseIP(ip).Equal(callerIP) {
+			return pc, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.PermissionDenied, "caller %s is not peer %q", host, address)
+}
+
+// takesOver reports whether this node should hold the cache entry id of a
+// zone once the leaving peer is gone.
+func (cm *CacheManager) takesOver(z *Zone, id, leaving string) bool {
+	r := cm.ring.Load()
+	if z.Replication != ReplicateOwned || r == nil || cm.self == "" {
+		return cm.owns(z, id)
+	}
+
+	// the owners left once a node is gone are the next ones on the ring
+	owners := r.Owners(id, z.ReplicationFactor+1)
+	for i, owner := range owners {
+		if owner == leaving {
+			owners = append(owners[:i:i], owners[i+1:]...)
+			break
+		}
+	}
+
+	if len(owners) > z.ReplicationFactor {
+		owners = owners[:z.ReplicationFactor]
+	}
+
+	return contains(owners, cm.self)
+}
@@ -0,0 +1,93 @@
+package nginx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_HandOff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	// node serves the zone of a cache manager, returning its address
+	node := func(cm *CacheManager) string {
+		t.Helper()
+
+		watcher := cm.Zones[0].Watcher
+		go watcher.Watch(ctx)
+
+		return newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": watcher}, Receiver: cm}).ID()
+	}
+
+	leaving := &CacheManager{
+		Zones:    []*Zone{{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}}},
+		Interval: time.Hour,
+		Logger:   zap.NewNop(),
+	}
+	leaving.Self = node(leaving)
+
+	remaining := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{parsePeer(t, leaving.Self)}},
+		Zones:      []*Zone{{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}}},
+		Interval:   time.Hour,
+		Logger:     zap.NewNop(),
+	}
+	remaining.Self = node(remaining)
+
+	go remaining.Reconcile(ctx)
+
+	leaving.Discoverer = &sd.StaticServiceDiscovery{Peers: []sd.Peer{parsePeer(t, remaining.Self)}}
+
+	a := writeCacheFile(t, leaving.Zones[0].Watcher.Directory, "/a", "HTTP/1.1 200 OK\r\n\r\n", "a")
+	b := writeCacheFile(t, leaving.Zones[0].Watcher.Directory, "/b", "HTTP/1.1 200 OK\r\n\r\n", "b")
+	require.Eventually(t, func() bool { return len(leaving.Zones[0].Watcher.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	go leaving.Reconcile(ctx)
+
+	// the hand-off is skipped until the peer is discovered
+	require.Eventually(t, func() bool { return leaving.HandOff(ctx) == 2 }, 10*time.Second, 100*time.Millisecond)
+
+	require.Eventually(t, func() bool { return len(remaining.Zones[0].Watcher.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	for _, id := range []string{a, b} {
+		_, found := remaining.Zones[0].Watcher.Get(id)
+		assert.True(t, found, id)
+	}
+
+	assert.Zero(t, leaving.HandOff(ctx), "the entries are held by the peer already")
+
+	t.Run("unknown peer", func(t *testing.T) {
+		conn, err := grpc.Dial(remaining.Self, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// a node serving the entry, yet not discovered
+		stranger := &CacheManager{Zones: []*Zone{{Name: "static", Watcher: &cr.CacheWatcher{Directory: t.TempDir()}}}, Logger: zap.NewNop()}
+		address := node(stranger)
+
+		c := writeCacheFile(t, stranger.Zones[0].Watcher.Directory, "/c", "HTTP/1.1 200 OK\r\n\r\n", "c")
+		require.Eventually(t, func() bool { _, found := stranger.Zones[0].Watcher.Get(c); return found }, 5*time.Second, 10*time.Millisecond)
+
+		ce, _ := stranger.Zones[0].Watcher.Get(c)
+
+		_, err = crv1.NewCacheRepositoryClient(conn).HandOff(ctx, &crv1.HandOffRequest{Zone: "static", Address: address, Items: []*crv1.CacheItem{crv1.NewCacheItem(ce)}})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, found := remaining.Zones[0].Watcher.Get(c)
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,63 @@
+package nginx
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/connectivity"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
+)
+
+var (
+	cacheEntriesDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "cache_entries"),
+		"Cache entries indexed, by zone.", []string{"zone"}, nil)
+
+	cacheBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "cache_bytes"),
+		"Size of the cache entries indexed, by zone.", []string{"zone"}, nil)
+
+	peersDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "peers"),
+		"Peers discovered (excluding this node).", nil, nil)
+
+	peerConnectionsDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "peer_connections"),
+		"Connections to peers, by state.", []string{"state"}, nil)
+)
+
+// connectionStates are always reported, even when no connection is in them.
+var connectionStates = []connectivity.State{
+	connectivity.Idle, connectivity.Connecting, connectivity.Ready, connectivity.TransientFailure, connectivity.Shutdown,
+}
+
+var _ prometheus.Collector = (*CacheManager)(nil)
+
+func (cm *CacheManager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntriesDesc
+	ch <- cacheBytesDesc
+	ch <- peersDesc
+	ch <- peerConnectionsDesc
+}
+
+// Collect reports the state of the cache zones and peer connections at the
+// time of the scrape.
+func (cm *CacheManager) Collect(ch chan<- prometheus.Metric) {
+	for _, z := range cm.Zones {
+		entries, bytes := z.Watcher.Stats()
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(entries), z.Name)
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(bytes), z.Name)
+	}
+
+	var peers int
+	states := make(map[connectivity.State]int)
+
+	cm.peers.Range(func(_, value any) bool {
+		peers++
+		states[value.(*peerConn).conn.GetState()]++
+		return true
+	})
+
+	ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(peers))
+
+	for _, state := range connectionStates {
+		ch <- prometheus.MustNewConstMetric(peerConnectionsDesc, prometheus.GaugeValue, float64(states[state]), strings.ToLower(state.String()))
+	}
+}
@@ -0,0 +1,56 @@
+package nginx_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_Collect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	peer := newTestPeer(t, nil)
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	go local.Watch(ctx)
+
+	writeCacheFile(t, local.Directory, "/a", "HTTP/1.1 200 OK\r\n\r\n", "a")
+	writeCacheFile(t, local.Directory, "/b", "HTTP/1.1 200 OK\r\n\r\n", "bb")
+	require.Eventually(t, func() bool { return len(local.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	entries, bytes := local.Stats()
+	assert.Equal(t, 2, entries)
+	assert.Positive(t, bytes)
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+		Zones:      []*Zone{{Name: "static", Watcher: local, Replication: ReplicateNone}},
+		Interval:   time.Hour,
+	}
+	go cm.Reconcile(ctx)
+
+	expected := `
+# HELP nginx_p2p_cache_cache_entries Cache entries indexed, by zone.
+# TYPE nginx_p2p_cache_cache_entries gauge
+nginx_p2p_cache_cache_entries{zone="static"} 2
+# HELP nginx_p2p_cache_peers Peers discovered (excluding this node).
+# TYPE nginx_p2p_cache_peers gauge
+nginx_p2p_cache_peers 1
+`
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(cm, strings.NewReader(expected), "nginx_p2p_cache_cache_entries", "nginx_p2p_cache_peers") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// every connection state is reported
+	assert.Equal(t, 5, testutil.CollectAndCount(cm, "nginx_p2p_cache_peer_connections"))
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package nginx
+
+import "io/fs"
+
+func chownAs(string, fs.FileInfo) error { return nil }
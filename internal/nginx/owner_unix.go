@@ -0,0 +1,24 @@
+//go:build unix
+
+package nginx
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// chownAs changes the owner of name to the owner of ref, so nginx workers can
+// keep managing the files and directories created by the sidecar.
+func chownAs(name string, ref fs.FileInfo) error {
+	st, ok := ref.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if int(st.Uid) == os.Geteuid() && int(st.Gid) == os.Getegid() {
+		return nil
+	}
+
+	return os.Lchown(name, int(st.Uid), int(st.Gid))
+}
@@ -0,0 +1,56 @@
+package nginx_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+// newTestPeer serves s over gRPC on a loopback address until the test ends,
+// returning the peer to discover. A nil s serves an empty, unwatched cache.
+func newTestPeer(t *testing.T, s *crv1.Server, opts ...grpc.ServerOption) sd.Peer {
+	t.Helper()
+
+	peer, _ := serveTestPeer(t, "127.0.0.1:0", s, opts...)
+	return peer
+}
+
+// serveTestPeer is newTestPeer on address, also returning a function which
+// stops the peer earlier, e.g. to restart it on the same address.
+func serveTestPeer(t *testing.T, address string, s *crv1.Server, opts ...grpc.ServerOption) (sd.Peer, func()) {
+	t.Helper()
+
+	if s == nil {
+		s = &crv1.Server{Cache: &cr.CacheWatcher{Directory: t.TempDir()}}
+	}
+
+	if s.Logger == nil {
+		s.Logger = zap.NewNop()
+	}
+
+	l, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	gs := grpc.NewServer(opts...)
+	crv1.RegisterCacheRepositoryServer(gs, s)
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	return parsePeer(t, l.Addr().String()), gs.Stop
+}
+
+func parsePeer(t *testing.T, address string) sd.Peer {
+	t.Helper()
+
+	peer, err := sd.ParsePeer(address)
+	require.NoError(t, err)
+
+	return peer
+}
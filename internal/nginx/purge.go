@@ -0,0 +1,150 @@
+package nginx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+var _ crv1.PurgeFanOut = (*CacheManager)(nil)
+
+// PurgePeers sends a purge to every peer, which do not pass it on any further.
+func (cm *CacheManager) PurgePeers(ctx context.Context, req *crv1.PurgeRequest) []*crv1.PeerPurge {
+	fwd := &crv1.PurgeRequest{Zone: req.GetZone(), Match: req.GetMatch()}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []*crv1.PeerPurge
+	)
+
+	cm.peers.Range(func(_, value any) bool {
+		pc := value.(*peerConn)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := &crv1.PeerPurge{Peer: pc.peer.Address(cm.Port)}
+
+			r, err := crv1.NewCacheRepositoryClient(pc.conn).Purge(ctx, fwd)
+			if err != nil {
+				cm.Logger.Error("Failed to purge peer cache", zap.String("peer", pc.peer.ID()), zap.String("zone", req.GetZone()), zap.Error(err))
+				result.Error = err.Error()
+			} else {
+				result.Purged = int64(len(r.Items))
+			}
+
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+
+		return true
+	})
+
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Peer < results[j].Peer })
+
+	return results
+}
+
+// PurgeHandler purges cache entries over HTTP (POST or DELETE), taking from
+// the query string the zone name (optional with a single zone), one of key
+// (exact proxy_cache_key), prefix or pattern (glob), and whether to fan_out
+// to peers (default false). It responds with the PurgeResponse as JSON.
+type PurgeHandler struct {
+	Manager *CacheManager
+	Server  crv1.CacheRepositoryServer
+	Logger  *zap.Logger
+}
+
+func (h *PurgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	z, ok := h.Manager.Zone(q.Get("zone"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cache zone %q", q.Get("zone")), http.StatusBadRequest)
+		return
+	}
+
+	req := &crv1.PurgeRequest{Zone: z.namespace()}
+
+	var matches int
+	for _, param := range []string{"key", "prefix", "pattern"} {
+		if !q.Has(param) {
+			continue
+		}
+
+		matches++
+
+		switch value := q.Get(param); param {
+		case "key":
+			req.Match = &crv1.PurgeRequest_Key{Key: value}
+
+		case "prefix":
+			req.Match = &crv1.PurgeRequest_Prefix{Prefix: value}
+
+		case "pattern":
+			req.Match = &crv1.PurgeRequest_Pattern{Pattern: value}
+		}
+	}
+
+	if matches != 1 {
+		http.Error(w, "exactly one of key, prefix or pattern is required", http.StatusBadRequest)
+		return
+	}
+
+	if q.Has("fan_out") {
+		fanOut, err := strconv.ParseBool(q.Get("fan_out"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fan_out %q", q.Get("fan_out")), http.StatusBadRequest)
+			return
+		}
+
+		req.FanOut = fanOut
+	}
+
+	resp, err := h.Server.Purge(r.Context(), req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			code = http.StatusBadRequest
+
+		case codes.NotFound:
+			code = http.StatusNotFound
+		}
+
+		http.Error(w, status.Convert(err).Message(), code)
+		return
+	}
+
+	h.Logger.Info("Purged cache entries", zap.String("zone", z.Name), zap.Any("match", req.GetMatch()), zap.Int("purged", len(resp.Items)), zap.Int("peers", len(resp.Peers)))
+
+	b, err := protojson.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
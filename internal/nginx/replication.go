@@ -0,0 +1,451 @@
+package nginx
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+const (
+	DefaultMaxConcurrentFetches = 4
+	DefaultMaxBytesPerCycle     = 64 * 1024 * 1024
+	DefaultMinRemainingTTL      = 10 * time.Second
+
+	maxWatchBackoff = 30 * time.Second
+)
+
+var (
+	errKeyMismatch = errors.New("cache key does not match entry")
+	errExpired     = errors.New("cache entry expired during the transfer")
+	errTombstoned  = errors.New("cache entry was deleted during the transfer")
+)
+
+type fetchTask struct {
+	zone *Zone
+	peer string
+	conn *grpc.ClientConn
+	item *crv1.CacheItem
+}
+
+// replicate pulls the cache entries this node should hold (according to the
+// replication policy of each zone) which are found on peers but missing
+// locally, within the byte budget of the current cycle.
+func (cm *CacheManager) replicate(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "replicate")
+	defer span.End()
+
+	var tasks []fetchTask
+	for _, z := range cm.Zones {
+		if z.Replication == ReplicateNone {
+			continue
+		}
+
+		tasks = append(tasks, cm.plan(ctx, z)...)
+	}
+
+	if len(tasks) == 0 {
+		return
+	}
+
+	var fetched, bytes atomic.Int64
+
+	eg, egctx := errgroup.WithContext(ctx)
+	eg.SetLimit(cm.MaxConcurrentFetches)
+
+	for _, t := range tasks {
+		t := t
+		eg.Go(func() error {
+			// spending what was reserved while planning, giving back the rest
+			var reserved atomic.Int64
+			reserved.Store(t.item.Size)
+			defer func() { cm.budget.Add(reserved.Load()) }()
+
+			if ok := cm.pull(egctx, t.zone, t.peer, t.conn, t.item, &reserved); ok {
+				fetched.Add(1)
+				bytes.Add(t.item.Size)
+			}
+			return nil
+		})
+	}
+
+	eg.Wait()
+
+	span.SetAttributes(attribute.Int("planned", len(tasks)), attribute.Int64("fetched", fetched.Load()), attribute.Int64("bytes", bytes.Load()))
+
+	cm.Logger.Info("Replication cycle finished", zap.Int("planned", len(tasks)), zap.Int64("fetched", fetched.Load()), zap.Int64("bytes", bytes.Load()))
+}
+
+// plan returns the entries of a zone to pull from peers, reserving their
+// sizes from the byte budget of the current cycle.
+func (cm *CacheManager) plan(ctx context.Context, z *Zone) (tasks []fetchTask) {
+	ctx, span := tracer.Start(ctx, "plan", trace.WithAttributes(attribute.String("zone", z.Name)))
+	defer span.End()
+
+	for _, holders := range cm.candidates(ctx, z) {
+		if t := holders[0]; reserve(&cm.budget, t.item.Size) {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return
+}
+
+// reserve takes size bytes from budget, reporting whether there were enough.
+func reserve(budget *atomic.Int64, size int64) bool {
+	if budget.Add(-size) < 0 {
+		budget.Add(size)
+		return false
+	}
+
+	return true
+}
+
+// candidates compares the caches of a zone with every peer, returning the
+// entries this node should hold but misses, by ID, along with one task per
+// peer holding them.
+func (cm *CacheManager) candidates(ctx context.Context, z *Zone) map[string][]fetchTask {
+	local := make(map[string]struct{})
+	for _, key := range z.Watcher.Keys() {
+		local[key] = struct{}{}
+	}
+
+	candidates := make(map[string][]fetchTask)
+
+	cm.peers.Range(func(key, value any) bool {
+		peer := key.(string)
+		cm.Logger.Debug("Calling RPC server", zap.String("peer", peer), zap.String("zone", z.Name))
+
+		pc := value.(*peerConn)
+		conn := pc.conn
+		items, err := cm.diff(ctx, z, conn)
+		if err != nil {
+			cm.Logger.Error("failed to compare cache", zap.String("peer", peer), zap.String("zone", z.Name), zap.Error(err))
+			metrics.ReplicationFailures.WithLabelValues(z.Name, "compare").Inc()
+			return true
+		}
+
+		pc.lastSync.Store(time.Now().UnixNano())
+
+		cm.Logger.Debug("Compared peer cache", zap.String("peer", peer), zap.String("zone", z.Name), zap.Int("items", len(items)))
+
+		for id, item := range items {
+			if _, found := local[id]; found {
+				continue
+			}
+
+			if !cm.owns(z, id) || !cm.fresh(item) || z.Watcher.Tombstoned(id) {
+				continue
+			}
+
+			candidates[id] = append(candidates[id], fetchTask{zone: z, peer: peer, conn: conn, item: item})
+		}
+
+		return true
+	})
+
+	return candidates
+}
+
+// watch follows the cache events of a peer zone, pulling new entries as soon
+// as they are announced. It reconnects (resuming from the last event) until
+// ctx is canceled.
+func (cm *CacheManager) watch(ctx context.Context, z *Zone, peer string, conn *grpc.ClientConn) {
+	var epoch, seq uint64
+
+	backoff := time.Second
+	for {
+		err := cm.watchEvents(ctx, z, peer, conn, &epoch, &seq)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if status.Code(err) == codes.OutOfRange { // missed events are picked up by the next reconcile
+			epoch, seq = 0, 0
+			cm.digestOf(peer, z).invalidate()
+		}
+
+		cm.Logger.Debug("Watch stream finished, reconnecting", zap.String("peer", peer), zap.String("zone", z.Name), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+func (cm *CacheManager) watchEvents(ctx context.Context, z *Zone, peer string, conn *grpc.ClientConn, epoch, seq *uint64) error {
+	stream, err := crv1.NewCacheRepositoryClient(conn).Watch(ctx, &crv1.WatchRequest{Zone: z.namespace(), Epoch: *epoch, SinceSequence: *seq})
+	if err != nil {
+		return err
+	}
+
+	for {
+		evt, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		*epoch, *seq = evt.Epoch, evt.Sequence
+
+		d := cm.digestOf(peer, z)
+		if d.observe(evt.Epoch, evt.Sequence) && evt.Type == crv1.WatchEvent_REMOVED {
+			d.remove() // earlier removals are in the digest already
+		}
+
+		if d.stale() {
+			go cm.refreshDigest(ctx, z, peer, conn, d)
+		}
+
+		if evt.Type == crv1.WatchEvent_TOMBSTONED {
+			cm.tombstone(z, peer, evt.Item)
+			continue
+		}
+
+		if evt.Type != crv1.WatchEvent_ADDED {
+			continue
+		}
+
+		d.add(evt.Item.Id)
+
+		if z.Replication == ReplicateNone {
+			continue
+		}
+
+		// waiting for a free slot holds the stream back meanwhile
+		if err := cm.pulls.Acquire(ctx, 1); err != nil {
+			return err
+		}
+
+		item := evt.Item
+		go func() {
+			defer cm.pulls.Release(1)
+			cm.pull(ctx, z, peer, conn, item, &cm.budget)
+		}()
+	}
+}
+
+// pull fetches a single entry from a peer unless it is already present,
+// owned by other nodes, tombstoned, being fetched, or over the bytes left in
+// budget. It reports whether the entry was fetched.
+func (cm *CacheManager) pull(ctx context.Context, z *Zone, peer string, conn *grpc.ClientConn, item *crv1.CacheItem, budget *atomic.Int64) bool {
+	if !cm.owns(z, item.Id) {
+		return false
+	}
+
+	return cm.transfer(ctx, z, peer, conn, item, budget)
+}
+
+// transfer is pull regardless of ownership, drawing from budget.
+func (cm *CacheManager) transfer(ctx context.Context, z *Zone, peer string, conn *grpc.ClientConn, item *crv1.CacheItem, budget *atomic.Int64) bool {
+	if _, found := z.Watcher.Get(item.Id); found {
+		return false
+	}
+
+	if !cm.fresh(item) || z.Watcher.Tombstoned(item.Id) {
+		return false
+	}
+
+	key := z.Name + "/" + item.Id
+	if _, loaded := cm.inflight.LoadOrStore(key, struct{}{}); loaded {
+		return false
+	}
+	defer cm.inflight.Delete(key)
+
+	if !reserve(budget, item.Size) {
+		return false
+	}
+
+	if err := cm.fetches.Acquire(ctx, 1); err != nil {
+		budget.Add(item.Size)
+		return false
+	}
+	defer cm.fetches.Release(1)
+
+	ctx, span := tracer.Start(ctx, "pull", trace.WithAttributes(
+		attribute.String("zone", z.Name),
+		attribute.String("peer", peer),
+		attribute.String("cache.id", item.Id),
+		attribute.String("cache.key", item.Key),
+		attribute.String("cache.valid", item.Valid.AsTime().Format(time.RFC3339)),
+	))
+	defer span.End()
+
+	size, err := cm.fetch(ctx, z, conn, item.Id)
+	if err != nil {
+		budget.Add(item.Size)
+		cm.Logger.Error("Failed to fetch cache entry", zap.String("peer", peer), zap.String("zone", z.Name), zap.String("id", item.Id), zap.Error(err))
+		metrics.ReplicationFailures.WithLabelValues(z.Name, failureReason(err)).Inc()
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, failureReason(err))
+		return false
+	}
+
+	metrics.ReplicatedEntries.WithLabelValues(z.Name).Inc()
+	metrics.ReplicatedBytes.WithLabelValues(z.Name).Add(float64(size))
+	span.SetAttributes(attribute.Int64("cache.size", size))
+
+	cm.Logger.Debug("Fetched cache entry", zap.String("peer", peer), zap.String("zone", z.Name), zap.String("id", item.Id), zap.Int64("size", item.Size), zap.String("trace_id", span.SpanContext().TraceID().String()))
+
+	return true
+}
+
+// fresh reports whether the entry is going to be valid for at least the
+// minimum remaining TTL.
+func (cm *CacheManager) fresh(item *crv1.CacheItem) bool {
+	valid := item.Valid.AsTime()
+	if valid.Unix() <= 0 { // no expiry
+		return true
+	}
+
+	return time.Until(valid) >= cm.MinRemainingTTL
+}
+
+// fetch downloads a cache entry from a peer zone and atomically moves it to
+// the place nginx expects it (according to levels), returning its size.
+func (cm *CacheManager) fetch(ctx context.Context, z *Zone, conn *grpc.ClientConn, id string) (int64, error) {
+	root, err := os.Stat(z.Watcher.Directory)
+	if err != nil {
+		return 0, err
+	}
+
+	dst := cr.CachePath(z.Watcher.Directory, z.Levels, id)
+	if err = mkdirAllAs(z.Watcher.Directory, filepath.Dir(dst), root); err != nil {
+		return 0, err
+	}
+
+	// NOTE: temporary file name is shorter than an md5 hex so the watcher ignores it.
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".p2p-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	defer tmp.Close()
+
+	stream, err := crv1.NewCacheRepositoryClient(conn).Fetch(ctx, &crv1.FetchRequest{Zone: z.namespace(), Id: id})
+	if err != nil {
+		return 0, err
+	}
+
+	header, err := crv1.ReceiveFetch(stream, tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	ce, err := cr.Unmarshal(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	if sum := md5.Sum([]byte(ce.Key)); hex.EncodeToString(sum[:]) != id {
+		return 0, fmt.Errorf("%w: %q, %s", errKeyMismatch, ce.Key, id)
+	}
+
+	if ce.Expired(time.Now()) {
+		return 0, fmt.Errorf("%w: %s", errExpired, id)
+	}
+
+	if z.Watcher.Tombstoned(id) {
+		return 0, fmt.Errorf("%w: %s", errTombstoned, id)
+	}
+
+	// NOTE: nginx workers usually run as a different user than the sidecar.
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return 0, err
+	}
+
+	if err = chownAs(tmp.Name(), root); err != nil {
+		return 0, err
+	}
+
+	if mtime := header.Modification.AsTime(); !mtime.IsZero() {
+		if err = os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return 0, err
+	}
+
+	return header.Size, nil
+}
+
+// failureReason classifies the errors of fetch for metrics.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, crv1.ErrChecksumMismatch):
+		return "checksum"
+
+	case errors.Is(err, errKeyMismatch):
+		return "key_mismatch"
+
+	case errors.Is(err, errExpired):
+		return "expired"
+
+	case errors.Is(err, errTombstoned):
+		return "tombstoned"
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return "rpc_" + strings.ToLower(s.Code().String())
+	}
+
+	return "other"
+}
+
+// mkdirAllAs creates dir and its missing parents below root, giving them the
+// same owner and permissions of root.
+func mkdirAllAs(root, dir string, ref os.FileInfo) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+
+	if rel == "." {
+		return nil
+	}
+
+	if err = mkdirAllAs(root, filepath.Dir(dir), ref); err != nil {
+		return err
+	}
+
+	err = os.Mkdir(dir, ref.Mode().Perm())
+	if os.IsExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return chownAs(dir, ref)
+}
@@ -0,0 +1,335 @@
+//go:build unix
+
+package nginx_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_Fetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+
+	id := writeCacheFile(t, remote.Directory, "/a", "HTTP/1.1 200 OK\r\n\r\n", "a")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(remote.Directory, id), mtime, mtime))
+
+	// an entry stored under the ID of another key
+	sum := md5.Sum([]byte("/b"))
+	forged := hex.EncodeToString(sum[:])
+	require.NoError(t, os.Rename(filepath.Join(remote.Directory, writeCacheFile(t, remote.Directory, "/not-b", "HTTP/1.1 200 OK\r\n\r\n", "b")), filepath.Join(remote.Directory, forged)))
+
+	go remote.Watch(ctx)
+	require.Eventually(t, func() bool { return len(remote.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote}})
+
+	conn, err := grpc.Dial(peer.ID(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	root := t.TempDir()
+	require.NoError(t, os.Chmod(root, 0o750))
+
+	var uid, gid int
+	if os.Geteuid() == 0 { // the cache directory belongs to the nginx user, not to the sidecar's
+		uid, gid = 4242, 4343
+		require.NoError(t, os.Chown(root, uid, gid))
+	}
+
+	cm := &CacheManager{}
+	z := &Zone{Name: "static", Watcher: &cr.CacheWatcher{Directory: root}, Levels: []int{1, 2}}
+
+	// leftovers tells the files in the cache directory besides its subdirectories
+	leftovers := func() (files []string) {
+		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		return
+	}
+
+	t.Run("key mismatch", func(t *testing.T) {
+		_, err := cm.Fetch(ctx, z, conn, forged)
+		assert.ErrorIs(t, err, ErrKeyMismatch)
+		assert.Empty(t, leftovers(), "the temporary file is removed")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := cm.Fetch(ctx, z, conn, "0123456789abcdef0123456789abcdef")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Empty(t, leftovers(), "the temporary file is removed")
+	})
+
+	t.Run("fetched", func(t *testing.T) {
+		size, err := cm.Fetch(ctx, z, conn, id)
+		require.NoError(t, err)
+
+		dst := cr.CachePath(root, z.Levels, id)
+		assert.Equal(t, []string{dst}, leftovers())
+
+		fi, err := os.Stat(dst)
+		require.NoError(t, err)
+		assert.Equal(t, size, fi.Size())
+		assert.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+		assert.True(t, mtime.Equal(fi.ModTime()), fi.ModTime())
+
+		for _, name := range []string{dst, filepath.Dir(dst), filepath.Dir(filepath.Dir(dst))} {
+			fi, err := os.Stat(name)
+			require.NoError(t, err)
+
+			if fi.IsDir() {
+				assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm(), name)
+			}
+
+			if uid != 0 {
+				st := fi.Sys().(*syscall.Stat_t)
+				assert.Equal(t, []int{uid, gid}, []int{int(st.Uid), int(st.Gid)}, name)
+			}
+		}
+	})
+}
+
+func TestMkdirAllAs(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Chmod(root, 0o711))
+
+	ref, err := os.Stat(root)
+	require.NoError(t, err)
+
+	existing := filepath.Join(root, "a")
+	require.NoError(t, os.Mkdir(existing, 0o755))
+
+	dir := filepath.Join(existing, "bc", "def")
+	require.NoError(t, MkdirAllAs(root, dir, ref))
+
+	for name, perm := range map[string]os.FileMode{
+		existing:                      0o755, // left as is
+		filepath.Join(existing, "bc"): 0o711,
+		dir:                           0o711,
+	} {
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, perm, fi.Mode().Perm(), name)
+	}
+
+	assert.NoError(t, MkdirAllAs(root, dir, ref), "already there")
+	assert.NoError(t, MkdirAllAs(root, root, ref))
+}
+
+func TestCacheManager_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+	go remote.Watch(ctx)
+
+	serve := func(address string, watcher *cr.CacheWatcher) (string, func()) {
+		peer, stop := serveTestPeer(t, address, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": watcher}})
+		return peer.ID(), stop
+	}
+
+	address, stop := serve("127.0.0.1:0", remote)
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	go local.Watch(ctx)
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{Peers: []sd.Peer{parsePeer(t, address)}},
+		Zones:      []*Zone{{Name: "static", Watcher: local, Replication: ReplicateAll}},
+		Interval:   time.Hour, // entries only come through Watch
+		Logger:     zap.NewNop(),
+	}
+	go cm.Reconcile(ctx)
+
+	pulled := func(id string) func() bool {
+		return func() bool { _, found := local.Get(id); return found }
+	}
+
+	// watching adds entries to a peer until one is pulled, telling that the
+	// watch on the peer is up
+	watching := func(dir, prefix string) {
+		t.Helper()
+
+		var added []string
+		require.Eventually(t, func() bool {
+			for _, id := range added {
+				if pulled(id)() {
+					return true
+				}
+			}
+
+			added = append(added, writeCacheFile(t, dir, fmt.Sprintf("%s-%d", prefix, len(added)), "HTTP/1.1 200 OK\r\n\r\n", "body"))
+			return false
+		}, 15*time.Second, 100*time.Millisecond)
+	}
+
+	watching(remote.Directory, "/a")
+
+	t.Run("since sequence", func(t *testing.T) {
+		stop()
+
+		// added while the stream is down, replayed once resumed
+		b := writeCacheFile(t, remote.Directory, "/b", "HTTP/1.1 200 OK\r\n\r\n", "b")
+		require.Eventually(t, func() bool { _, found := remote.Get(b); return found }, 5*time.Second, 10*time.Millisecond)
+
+		_, stop = serve(address, remote)
+
+		require.Eventually(t, pulled(b), 10*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("epoch change", func(t *testing.T) {
+		stop()
+
+		// the peer restarts, its journal starting over: resuming is impossible,
+		// so the watch starts over from the current state
+		restarted := &cr.CacheWatcher{Directory: t.TempDir()}
+		go restarted.Watch(ctx)
+
+		_, stop = serve(address, restarted)
+		defer stop()
+
+		watching(restarted.Directory, "/c")
+	})
+}
+
+func TestCacheManager_Replicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, writeCacheFile(t, remote.Directory, fmt.Sprintf("/%d", i), "HTTP/1.1 200 OK\r\n\r\n", "body"))
+	}
+
+	go remote.Watch(ctx)
+	require.Eventually(t, func() bool { return len(remote.Keys()) == 5 }, 5*time.Second, 10*time.Millisecond)
+
+	ce, _ := remote.Get(ids[0])
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote}})
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	go local.Watch(ctx)
+
+	cm := &CacheManager{
+		Discoverer:       &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+		Zones:            []*Zone{{Name: "static", Watcher: local, Replication: ReplicateAll}},
+		Interval:         time.Hour,
+		Logger:           zap.NewNop(),
+		MaxBytesPerCycle: 2*ce.Size + ce.Size/2,
+	}
+	go cm.Reconcile(ctx)
+
+	require.Eventually(t, func() bool { return len(cm.Lookup("static", ids[0])) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	cm.Replicate(ctx)
+
+	require.Eventually(t, func() bool { return len(local.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, ce.Size/2, cm.Budget(), "planned and spent from the same budget")
+
+	// nothing fits in what is left of the cycle
+	cm.Replicate(ctx)
+
+	assert.Len(t, local.Keys(), 2)
+	assert.Equal(t, ce.Size/2, cm.Budget())
+}
+
+func TestCacheManager_Fresh(t *testing.T) {
+	cm := &CacheManager{MinRemainingTTL: time.Minute}
+
+	for _, tt := range []struct {
+		name     string
+		valid    *timestamppb.Timestamp
+		expected bool
+	}{
+		{name: "no valid time", expected: true},
+		{name: "zero valid time", valid: timestamppb.New(time.Unix(0, 0)), expected: true},
+		{name: "valid for long", valid: timestamppb.New(time.Now().Add(time.Hour)), expected: true},
+		{name: "expiring before the minimum TTL", valid: timestamppb.New(time.Now().Add(time.Second))},
+		{name: "expired", valid: timestamppb.New(time.Now().Add(-time.Second))},
+		{name: "expired long ago", valid: timestamppb.New(time.Now().Add(-24 * time.Hour))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, cm.Fresh(&crv1.CacheItem{Id: "0123456789abcdef0123456789abcdef", Valid: tt.valid}))
+		})
+	}
+}
+
+func TestCacheManager_Pull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+	older := writeCacheFile(t, remote.Directory, "/a", "HTTP/1.1 200 OK\r\n\r\n", "remote")
+	missing := writeCacheFile(t, remote.Directory, "/b", "HTTP/1.1 200 OK\r\n\r\n", "remote")
+
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(remote.Directory, older), mtime, mtime))
+
+	go remote.Watch(ctx)
+	require.Eventually(t, func() bool { return len(remote.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote}})
+
+	conn, err := grpc.Dial(peer.ID(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	writeCacheFile(t, local.Directory, "/a", "HTTP/1.1 200 OK\r\n\r\n", "local")
+
+	go local.Watch(ctx)
+	require.Eventually(t, func() bool { return len(local.Keys()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	cm := &CacheManager{
+		Discoverer: &sd.StaticServiceDiscovery{},
+		Zones:      []*Zone{{Name: "static", Watcher: local, Replication: ReplicateAll}},
+		Interval:   time.Hour,
+		Logger:     zap.NewNop(),
+	}
+	go cm.Reconcile(ctx)
+
+	item := func(id string) *crv1.CacheItem {
+		ce, found := remote.Get(id)
+		require.True(t, found)
+		return crv1.NewCacheItem(ce)
+	}
+
+	require.Eventually(t, func() bool { return cm.Pull(ctx, cm.Zones[0], conn, item(missing)) }, 5*time.Second, 10*time.Millisecond)
+
+	assert.False(t, cm.Pull(ctx, cm.Zones[0], conn, item(older)), "the local copy is newer")
+
+	ce, _ := local.Get(older)
+	b, err := os.ReadFile(ce.Filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "local")
+}
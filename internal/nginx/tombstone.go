@@ -0,0 +1,52 @@
+package nginx
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+)
+
+// syncTombstones applies the tombstones of every peer zone, catching up with
+// those missed while Watch streams were down.
+func (cm *CacheManager) syncTombstones(ctx context.Context) {
+	cm.peers.Range(func(key, value any) bool {
+		peer, client := key.(string), crv1.NewCacheRepositoryClient(value.(*peerConn).conn)
+
+		for _, z := range cm.Zones {
+			r, err := client.Tombstones(ctx, &crv1.TombstonesRequest{Zone: z.namespace()})
+			if err != nil {
+				cm.Logger.Error("Failed to get peer tombstones", zap.String("peer", peer), zap.String("zone", z.Name), zap.Error(err))
+				continue
+			}
+
+			for _, item := range r.Items {
+				cm.tombstone(z, peer, item)
+			}
+		}
+
+		return true
+	})
+}
+
+// tombstone deletes the local copy of an entry deleted on purpose by a peer,
+// keeping it from being replicated back until the tombstone expires. The
+// tombstone is passed on to the peers of this node as well.
+func (cm *CacheManager) tombstone(z *Zone, peer string, item *crv1.CacheItem) {
+	ce := cr.CacheEntry{ID: item.Id, Key: item.Key}
+	if item.RemovedAt != nil {
+		ce.RemovedAt = item.RemovedAt.AsTime()
+	}
+
+	applied, err := z.Watcher.Tombstone(ce)
+	if err != nil {
+		cm.Logger.Error("Failed to delete tombstoned cache entry", zap.String("peer", peer), zap.String("zone", z.Name), zap.String("id", item.Id), zap.Error(err))
+		return
+	}
+
+	if applied {
+		cm.Logger.Debug("Applied cache entry tombstone", zap.String("peer", peer), zap.String("zone", z.Name), zap.String("id", item.Id))
+	}
+}
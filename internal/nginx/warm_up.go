@@ -0,0 +1,216 @@
+package nginx
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultWarmUpTimeout = 30 * time.Second
+
+	// warmUpPeerGrace is how long the warm-up waits for the first peer to be
+	// discovered, as there may be none (e.g. the first node of the cluster).
+	warmUpPeerGrace = 5 * time.Second
+	warmUpPoll      = 100 * time.Millisecond
+)
+
+// WarmUpStatus is the outcome of the warm-up, when this node pulls from peers
+// the entries it should hold before reporting ready.
+type WarmUpStatus struct {
+	// Done is whether the warm-up finished (or is disabled).
+	Done bool `json:"done"`
+	// TimedOut is whether the warm-up was cut short by its timeout.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Entries and Bytes were pulled during the warm-up.
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// TargetBytes is the byte target of the warm-up; 0 means every entry.
+	TargetBytes    int64   `json:"target_bytes,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+type warmUpState struct {
+	mu     sync.Mutex
+	status WarmUpStatus
+}
+
+// WarmUp returns the status of the warm-up.
+func (cm *CacheManager) WarmUp() WarmUpStatus {
+	cm.warm.mu.Lock()
+	defer cm.warm.mu.Unlock()
+
+	return cm.warm.status
+}
+
+func (cm *CacheManager) setWarmUp(status WarmUpStatus) {
+	cm.warm.mu.Lock()
+	defer cm.warm.mu.Unlock()
+
+	cm.warm.status = status
+}
+
+// warmUp pulls from peers the entries this node should hold, the hottest
+// first (i.e. held by more peers, then most recently modified), until the
+// byte target is reached, nothing is left to pull, or the timeout expires.
+func (cm *CacheManager) warmUp(ctx context.Context) {
+	if cm.WarmUpTimeout <= 0 {
+		cm.setWarmUp(WarmUpStatus{Done: true})
+		return
+	}
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, cm.WarmUpTimeout)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "warm-up")
+	defer span.End()
+
+	target := cm.WarmUpBytes
+	if target <= 0 {
+		target = math.MaxInt64
+	}
+
+	var fetched, bytes atomic.Int64
+
+	// NOTE: the warm-up runs before the first replication cycle, so the byte
+	// budget of the cycle is borrowed meanwhile.
+	cm.budget.Store(target)
+	defer cm.budget.Store(cm.MaxBytesPerCycle)
+
+	cm.Logger.Info("Warming up cache", zap.Duration("timeout", cm.WarmUpTimeout), zap.Int64("target_bytes", cm.WarmUpBytes))
+
+	if cm.waitWarmUpPeers(ctx) {
+		// peers discovered meanwhile may hold further entries, so rounds go on
+		// until one pulls nothing
+		for ctx.Err() == nil && bytes.Load() < target {
+			tasks := cm.warmUpPlan(ctx, target-bytes.Load())
+			if len(tasks) == 0 {
+				break
+			}
+
+			var round atomic.Int64
+
+			eg, egctx := errgroup.WithContext(ctx)
+			eg.SetLimit(cm.MaxConcurrentFetches)
+
+			for _, holders := range tasks {
+				holders := holders
+				eg.Go(func() error {
+					for _, t := range holders { // trying the other holders on failures
+						if cm.pull(egctx, t.zone, t.peer, t.conn, t.item, &cm.budget) {
+							round.Add(1)
+							fetched.Add(1)
+							bytes.Add(t.item.Size)
+							return nil
+						}
+
+						if _, found := t.zone.Watcher.Get(t.item.Id); found || egctx.Err() != nil {
+							return nil
+						}
+					}
+					return nil
+				})
+			}
+
+			eg.Wait()
+
+			if round.Load() == 0 {
+				break
+			}
+		}
+	}
+
+	status := WarmUpStatus{
+		Done:           true,
+		TimedOut:       errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Entries:        fetched.Load(),
+		Bytes:          bytes.Load(),
+		TargetBytes:    cm.WarmUpBytes,
+		ElapsedSeconds: time.Since(start).Seconds(),
+	}
+
+	cm.setWarmUp(status)
+
+	span.SetAttributes(attribute.Int64("fetched", status.Entries), attribute.Int64("bytes", status.Bytes), attribute.Bool("timed_out", status.TimedOut))
+
+	cm.Logger.Info("Cache warm-up finished", zap.Int64("fetched", status.Entries), zap.Int64("bytes", status.Bytes), zap.Bool("timed_out", status.TimedOut), zap.Duration("elapsed", time.Since(start)))
+}
+
+// waitWarmUpPeers waits for the cache zones to be synced with their
+// directories and for a peer to be discovered. It reports false when there
+// is nothing to warm up from.
+func (cm *CacheManager) waitWarmUpPeers(ctx context.Context) bool {
+	grace := time.NewTimer(warmUpPeerGrace)
+	defer grace.Stop()
+
+	ticker := time.NewTicker(warmUpPoll)
+	defer ticker.Stop()
+
+	for {
+		synced, peers := true, false
+		for _, z := range cm.Zones {
+			synced = synced && z.Watcher.Synced()
+		}
+
+		cm.peers.Range(func(_, _ any) bool {
+			peers = true
+			return false
+		})
+
+		if synced && peers {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-grace.C:
+			if !peers {
+				return false
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// warmUpPlan returns the entries to pull within budget, the hottest first,
+// each with the tasks to pull it from every peer holding it.
+func (cm *CacheManager) warmUpPlan(ctx context.Context, budget int64) (tasks [][]fetchTask) {
+	for _, z := range cm.Zones {
+		if z.Replication == ReplicateNone {
+			continue
+		}
+
+		for _, holders := range cm.candidates(ctx, z) {
+			tasks = append(tasks, holders)
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if len(tasks[i]) != len(tasks[j]) {
+			return len(tasks[i]) > len(tasks[j])
+		}
+
+		return tasks[i][0].item.Modification.AsTime().After(tasks[j][0].item.Modification.AsTime())
+	})
+
+	planned := tasks[:0]
+	for _, holders := range tasks {
+		if size := holders[0].item.Size; size <= budget {
+			budget -= size
+			planned = append(planned, holders)
+		}
+	}
+
+	return planned
+}
@@ -0,0 +1,69 @@
+package nginx_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	crv1 "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestCacheManager_WarmUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	remote := &cr.CacheWatcher{Directory: t.TempDir()}
+
+	// the most recently modified entries are the hottest ones
+	ids := make(map[string]string)
+	for i, key := range []string{"/cold", "/mild", "/warm"} {
+		ids[key] = writeCacheFile(t, remote.Directory, key, "HTTP/1.1 200 OK\r\n\r\n", "body")
+
+		mtime := time.Now().Add(time.Duration(i-3) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(remote.Directory, ids[key]), mtime, mtime))
+	}
+
+	go remote.Watch(ctx)
+	require.Eventually(t, func() bool { return len(remote.Keys()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	ce, _ := remote.Get(ids["/warm"])
+
+	peer := newTestPeer(t, &crv1.Server{Zones: map[string]*cr.CacheWatcher{"static": remote}})
+
+	local := &cr.CacheWatcher{Directory: t.TempDir()}
+	go local.Watch(ctx)
+
+	cm := &CacheManager{
+		Discoverer:    &sd.StaticServiceDiscovery{Peers: []sd.Peer{peer}},
+		Zones:         []*Zone{{Name: "static", Watcher: local, Replication: ReplicateAll}},
+		Interval:      time.Hour,
+		Logger:        zap.NewNop(),
+		WarmUpTimeout: 5 * time.Second,
+		WarmUpBytes:   2 * ce.Size,
+	}
+
+	assert.False(t, cm.WarmUp().Done)
+
+	go cm.Reconcile(ctx)
+
+	require.Eventually(t, func() bool { return cm.WarmUp().Done }, 10*time.Second, 10*time.Millisecond)
+
+	status := cm.WarmUp()
+	assert.False(t, status.TimedOut)
+	assert.EqualValues(t, 2, status.Entries)
+	assert.Equal(t, 2*ce.Size, status.Bytes)
+
+	require.Eventually(t, func() bool { return len(local.Keys()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	_, found := local.Get(ids["/cold"])
+	assert.False(t, found, "the coldest entry is left out of the byte target")
+}
@@ -0,0 +1,97 @@
+package nginx
+
+import (
+	"fmt"
+
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+// ReplicationPolicy defines which entries of a zone are pulled from peers.
+type ReplicationPolicy string
+
+const (
+	// ReplicateOwned pulls the entries this node owns according to the hash ring.
+	ReplicateOwned ReplicationPolicy = "owned"
+	// ReplicateAll pulls every entry found on peers, mirroring the whole zone.
+	ReplicateAll ReplicationPolicy = "all"
+	// ReplicateNone never pulls entries; they are only served to peers.
+	ReplicateNone ReplicationPolicy = "none"
+
+	DefaultReplicationFactor = 2
+)
+
+func ParseReplicationPolicy(s string) (ReplicationPolicy, error) {
+	switch p := ReplicationPolicy(s); p {
+	case ReplicateOwned, ReplicateAll, ReplicateNone:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown replication policy %q", s)
+}
+
+// Zone is a cache zone (proxy_cache_path) shared with peers. Entries are only
+// exchanged with the zone of the same namespace on peers.
+type Zone struct {
+	Name string
+	// Namespace is the name of the zone on peers; defaults to Name.
+	Namespace string
+	Watcher   *cr.CacheWatcher
+	// Levels is the subdirectory layout of the zone (proxy_cache_path levels).
+	Levels []int
+
+	// Replication defaults to ReplicateOwned.
+	Replication ReplicationPolicy
+	// ReplicationFactor is the number of nodes owning each entry when
+	// replicating owned entries.
+	ReplicationFactor int
+}
+
+// namespace returns the name of the zone on the wire.
+func (z *Zone) namespace() string {
+	if z.Namespace != "" {
+		return z.Namespace
+	}
+
+	return z.Name
+}
+
+func (z *Zone) setDefaults() {
+	if z.Replication == "" {
+		z.Replication = ReplicateOwned
+	}
+
+	if z.ReplicationFactor <= 0 {
+		z.ReplicationFactor = DefaultReplicationFactor
+	}
+}
+
+// Zone returns the zone by name; an empty name refers to the only zone, if
+// there is a single one.
+func (cm *CacheManager) Zone(name string) (*Zone, bool) {
+	if name == "" && len(cm.Zones) == 1 {
+		return cm.Zones[0], true
+	}
+
+	for _, z := range cm.Zones {
+		if z.Name == name {
+			return z, true
+		}
+	}
+
+	return nil, false
+}
+
+// zoneOf returns the zone of a namespace, as named on the wire.
+func (cm *CacheManager) zoneOf(namespace string) (*Zone, bool) {
+	if namespace == "" && len(cm.Zones) == 1 {
+		return cm.Zones[0], true
+	}
+
+	for _, z := range cm.Zones {
+		if z.namespace() == namespace {
+			return z, true
+		}
+	}
+
+	return nil, false
+}
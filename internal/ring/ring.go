@@ -0,0 +1,106 @@
+package ring
+
+import (
+	"crypto/md5" // #nosec G501 -- used for distribution, not security
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const DefaultVirtualNodes = 128
+
+// Ring is an immutable consistent hashing ring. Each node is placed on the
+// ring many times (virtual nodes) to spread keys evenly; a key is owned by
+// the first distinct nodes found clockwise from its position.
+type Ring struct {
+	points []point
+	nodes  []string
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// New builds a ring with the given number of virtual nodes per node.
+func New(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	unique := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		unique[n] = struct{}{}
+	}
+
+	r := &Ring{points: make([]point, 0, len(unique)*vnodes)}
+
+	for n := range unique {
+		r.nodes = append(r.nodes, n)
+
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: hash(n + "#" + strconv.Itoa(i)), node: n})
+		}
+	}
+
+	sort.Strings(r.nodes)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash { // keeping the order deterministic on collisions
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// Nodes returns the nodes in the ring, sorted.
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Owners returns up to n distinct nodes responsible for key, the primary
+// owner first.
+func (r *Ring) Owners(key string, n int) []string {
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+
+		if !contains(owners, p.node) {
+			owners = append(owners, p.node)
+		}
+	}
+
+	return owners
+}
+
+// IsOwner reports whether node is among the n owners of key.
+func (r *Ring) IsOwner(node, key string, n int) bool {
+	return contains(r.Owners(key, n), node)
+}
+
+func hash(s string) uint64 {
+	sum := md5.Sum([]byte(s)) // #nosec G401
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
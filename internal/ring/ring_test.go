@@ -0,0 +1,60 @@
+package ring_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/ring"
+)
+
+func TestRing_Owners(t *testing.T) {
+	r := New(DefaultVirtualNodes, "10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000")
+
+	owners := r.Owners("b7f54b2df7773722d382f4809d65029c", 2)
+	assert.Len(t, owners, 2)
+	assert.NotEqual(t, owners[0], owners[1])
+
+	// deterministic regardless of the order nodes were given
+	assert.Equal(t, owners, New(DefaultVirtualNodes, "10.0.0.3:8000", "10.0.0.1:8000", "10.0.0.2:8000").Owners("b7f54b2df7773722d382f4809d65029c", 2))
+
+	for _, node := range []string{"10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000"} {
+		assert.Equal(t, node == owners[0] || node == owners[1], r.IsOwner(node, "b7f54b2df7773722d382f4809d65029c", 2), node)
+	}
+
+	// capped by the number of nodes
+	assert.Len(t, r.Owners("b7f54b2df7773722d382f4809d65029c", 5), 3)
+
+	assert.Empty(t, New(DefaultVirtualNodes).Owners("b7f54b2df7773722d382f4809d65029c", 1))
+}
+
+func TestRing_Balance(t *testing.T) {
+	nodes := []string{"10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000", "10.0.0.4:8000"}
+	r := New(DefaultVirtualNodes, nodes...)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.Owners(fmt.Sprintf("/asset/%d", i), 1)[0]]++
+	}
+
+	for _, n := range nodes {
+		assert.InDelta(t, 2500, counts[n], 500, n)
+	}
+}
+
+func TestRing_MinimalMovement(t *testing.T) {
+	before := New(DefaultVirtualNodes, "10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000")
+	after := New(DefaultVirtualNodes, "10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000", "10.0.0.4:8000")
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("/asset/%d", i)
+		if before.Owners(key, 1)[0] != after.Owners(key, 1)[0] {
+			moved++
+		}
+	}
+
+	// ideally a quarter of the keys move to the new node
+	assert.InDelta(t, 2500, moved, 600)
+}
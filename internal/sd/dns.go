@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
-	"sync"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -17,22 +17,25 @@ type DNSServiceDiscovery struct {
 	Interval    time.Duration
 	Logger      *zap.Logger
 	DisableIPv6 bool
-
-	added   chan string
-	removed chan string
-
-	data sync.Map
-	o    sync.Once
-}
-
-func (dsd *DNSServiceDiscovery) Added() <-chan string {
-	dsd.startChannels()
-	return dsd.added
-}
-
-func (dsd *DNSServiceDiscovery) Removed() <-chan string {
-	dsd.startChannels()
-	return dsd.removed
+	// SRV looks up SRV records (e.g. "_grpc._tcp.my-service.default.svc.cluster.local")
+	// instead of A/AAAA ones, so every peer carries its own port and weight.
+	SRV bool
+
+	// Server is the address (host:port) of the DNS server to query; empty
+	// uses the servers from the system configuration.
+	Server string
+	// UseTCP sends queries over TCP instead of UDP.
+	UseTCP bool
+	// Timeout of each DNS query; zero means no timeout besides the one of
+	// the system configuration.
+	Timeout time.Duration
+	// DisableSearch treats Domain as fully qualified, skipping the search
+	// domains from the system configuration.
+	DisableSearch bool
+	// Resolver overrides the resolver built from the options above.
+	Resolver *net.Resolver
+
+	peerSet
 }
 
 func (dsd *DNSServiceDiscovery) Discover(ctx context.Context) error {
@@ -40,21 +43,26 @@ func (dsd *DNSServiceDiscovery) Discover(ctx context.Context) error {
 		return err
 	}
 
-	dsd.startChannels()
-	defer close(dsd.added)
-	defer close(dsd.removed)
+	defer dsd.close()
 
 	if dsd.Logger == nil {
 		dsd.Logger = zap.NewNop()
 	}
 
-	dsd.Logger = dsd.Logger.With(zap.String("sd_method", "dns"), zap.String("domain", dsd.Domain), zap.Bool("disable_ipv6", dsd.DisableIPv6))
+	dsd.Logger = dsd.Logger.With(zap.String("sd_method", "dns"), zap.String("domain", dsd.Domain), zap.Bool("disable_ipv6", dsd.DisableIPv6), zap.Bool("srv", dsd.SRV), zap.String("server", dsd.Server))
+
+	dsd.Resolver = dsd.HostResolver()
+
+	domain := dsd.Domain
+	if dsd.DisableSearch && !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
 
 	dsd.Logger.Debug("Starting service discovery")
 	defer dsd.Logger.Debug("Finishing service discovery")
 
 	// NOTE: running the first discover call outside of loop to catch and return possible DNS resolution errors.
-	if err := dsd.discoverPeersByDomain(dsd.Domain); err != nil {
+	if err := dsd.discoverPeersByDomain(ctx, domain); err != nil {
 		return err
 	}
 
@@ -64,7 +72,7 @@ func (dsd *DNSServiceDiscovery) Discover(ctx context.Context) error {
 	for {
 		select {
 		case <-tc.C:
-			if err := dsd.discoverPeersByDomain(dsd.Domain); err != nil {
+			if err := dsd.discoverPeersByDomain(ctx, domain); err != nil {
 				dsd.Logger.Error("Failed to discover peers", zap.Error(err))
 			}
 
@@ -74,75 +82,107 @@ func (dsd *DNSServiceDiscovery) Discover(ctx context.Context) error {
 	}
 }
 
-func (dsd *DNSServiceDiscovery) discoverPeersByDomain(domain string) error {
+func (dsd *DNSServiceDiscovery) discoverPeersByDomain(ctx context.Context, domain string) error {
 	dsd.Logger.Debug("Looking up peers from DNS")
 
-	network := "ip"
-	if dsd.DisableIPv6 {
-		network = "ip4"
+	notifyCtx := ctx // not bound to the query timeout
+
+	lookup := dsd.lookupIP
+	if dsd.SRV {
+		lookup = dsd.lookupSRV
+	}
+
+	if dsd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dsd.Timeout)
+		defer cancel()
 	}
 
-	ips, err := net.DefaultResolver.LookupIP(context.Background(), network, domain)
+	peers, err := lookup(ctx, domain)
 	if err != nil {
 		var dnsErr *net.DNSError
 		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
 			dsd.Logger.Debug("No entries found")
+			dsd.update(notifyCtx, nil)
 			return nil
 		}
 
 		return err
 	}
 
-	ipsStr := make([]string, 0, len(ips))
-	for _, ip := range ips {
-		ipsStr = append(ipsStr, ip.String())
-	}
-
-	dsd.Logger.Debug("DNS query finished succesfully", zap.Strings("ips", ipsStr))
+	dsd.Logger.Debug("DNS query finished succesfully", zap.Stringers("peers", peers))
 
-	go dsd.notifyChanges(ipsStr)
+	dsd.update(notifyCtx, peers)
 
 	return nil
 }
 
-func (dsd *DNSServiceDiscovery) notifyChanges(ips []string) {
-	observed := make(map[string]struct{})
-	for _, ip := range ips {
-		observed[ip] = struct{}{}
+func (dsd *DNSServiceDiscovery) lookupIP(ctx context.Context, domain string) ([]Peer, error) {
+	network := "ip"
+	if dsd.DisableIPv6 {
+		network = "ip4"
 	}
 
-	actual := make(map[string]struct{})
-	dsd.data.Range(func(key, _ any) bool {
-		actual[key.(string)] = struct{}{}
-		return true
-	})
-
-	var toAdd, toRemove []string
+	ips, err := dsd.Resolver.LookupIP(ctx, network, domain)
+	if err != nil {
+		return nil, err
+	}
 
-	for ip := range observed {
-		if _, found := actual[ip]; !found {
-			toAdd = append(toAdd, ip)
-		}
+	peers := make([]Peer, 0, len(ips))
+	for _, ip := range ips {
+		peers = append(peers, Peer{Host: ip.String()})
 	}
 
-	for ip := range actual {
-		if _, found := observed[ip]; !found {
-			toRemove = append(toRemove, ip)
-		}
+	return peers, nil
+}
+
+func (dsd *DNSServiceDiscovery) lookupSRV(ctx context.Context, domain string) ([]Peer, error) {
+	_, records, err := dsd.Resolver.LookupSRV(ctx, "", "", domain)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, ip := range toAdd {
-		dsd.added <- ip
-		dsd.data.Store(ip, struct{}{})
+	peers := make([]Peer, 0, len(records))
+	for _, r := range records {
+		peers = append(peers, Peer{
+			Host:   strings.TrimSuffix(r.Target, "."),
+			Port:   int(r.Port),
+			Weight: r.Weight,
+		})
 	}
 
-	for _, ip := range toRemove {
-		dsd.removed <- ip
-		dsd.data.Delete(ip)
+	return peers, nil
+}
+
+// HostResolver returns the resolver peers are looked up through: Resolver,
+// or one built from the options above when nil. Host names of the peers
+// found should be resolved through it as well.
+func (dsd *DNSServiceDiscovery) HostResolver() *net.Resolver {
+	if dsd.Resolver != nil {
+		return dsd.Resolver
 	}
 
+	return dsd.newResolver()
 }
 
-func (dsd *DNSServiceDiscovery) startChannels() {
-	dsd.o.Do(func() { dsd.added, dsd.removed = make(chan string), make(chan string) })
+func (dsd *DNSServiceDiscovery) newResolver() *net.Resolver {
+	if dsd.Server == "" && !dsd.UseTCP {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dsd.Server != "" {
+				address = dsd.Server
+			}
+
+			if dsd.UseTCP {
+				network = "tcp"
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
 }
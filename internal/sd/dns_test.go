@@ -2,9 +2,16 @@ package sd_test
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
 
 	. "github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
 )
@@ -13,22 +20,246 @@ func TestDNSServiceDiscovery_Discover_ContextCanceled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.TODO())
 	cancel()
 
-	err := NewServiceDiscoveryDNS("my-sd-domain.examle.com").Discover(ctx, nil)
+	err := (&DNSServiceDiscovery{Domain: "my-sd-domain.examle.com", Interval: time.Second}).Discover(ctx)
 	assert.Error(t, err)
 	assert.EqualError(t, err, "context canceled")
 }
 
 func TestDNSServiceDiscovery_Discover(t *testing.T) {
-	peers := make(chan string)
-	defer close(peers)
+	zone := newDNSZone()
+	zone.setA("my-sd-domain.example.com.", "169.196.255.255")
 
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 
+	dsd := &DNSServiceDiscovery{
+		Domain:        "my-sd-domain.example.com",
+		Interval:      10 * time.Millisecond,
+		Server:        zone.serveUDP(t),
+		DisableSearch: true,
+		DisableIPv6:   true,
+	}
+
+	go func() {
+		err := dsd.Discover(ctx)
+		assert.NoError(t, err)
+	}()
+
+	assert.Equal(t, Peer{Host: "169.196.255.255"}, receive(t, dsd.Added()))
+
+	zone.setA("my-sd-domain.example.com.", "169.196.255.255", "169.196.255.254")
+	assert.Equal(t, Peer{Host: "169.196.255.254"}, receive(t, dsd.Added()))
+
+	zone.delete("my-sd-domain.example.com.") // NXDOMAIN
+	removed := []Peer{receive(t, dsd.Removed()), receive(t, dsd.Removed())}
+	assert.ElementsMatch(t, []Peer{{Host: "169.196.255.255"}, {Host: "169.196.255.254"}}, removed)
+}
+
+func TestDNSServiceDiscovery_Discover_SRVOverTCP(t *testing.T) {
+	zone := newDNSZone()
+	zone.setSRV("_grpc._tcp.my-sd-domain.example.com.",
+		net.SRV{Target: "peer-1.example.com.", Port: 8001, Weight: 10},
+		net.SRV{Target: "peer-2.example.com.", Port: 8002, Weight: 20},
+	)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	dsd := &DNSServiceDiscovery{
+		Domain:        "_grpc._tcp.my-sd-domain.example.com",
+		Interval:      time.Minute,
+		SRV:           true,
+		Server:        zone.serveTCP(t),
+		UseTCP:        true,
+		DisableSearch: true,
+	}
+
 	go func() {
-		err := NewServiceDiscoveryDNS("my-sd-domain.169-196-255-255.nip.io").Discover(ctx, peers)
+		err := dsd.Discover(ctx)
 		assert.NoError(t, err)
 	}()
 
-	assert.Equal(t, "169.196.255.255", <-peers)
+	added := []Peer{receive(t, dsd.Added()), receive(t, dsd.Added())}
+	assert.ElementsMatch(t, []Peer{
+		{Host: "peer-1.example.com", Port: 8001, Weight: 10},
+		{Host: "peer-2.example.com", Port: 8002, Weight: 20},
+	}, added)
+}
+
+func TestDNSServiceDiscovery_Discover_Timeout(t *testing.T) {
+	// a server which never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	dsd := &DNSServiceDiscovery{
+		Domain:        "my-sd-domain.example.com",
+		Interval:      time.Second,
+		Server:        pc.LocalAddr().String(),
+		Timeout:       100 * time.Millisecond,
+		DisableSearch: true,
+	}
+
+	start := time.Now()
+	err = dsd.Discover(context.TODO())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// dnsZone is a minimal in-process authoritative DNS server.
+type dnsZone struct {
+	mu  sync.Mutex
+	a   map[string][]net.IP
+	srv map[string][]net.SRV
+}
+
+func newDNSZone() *dnsZone {
+	return &dnsZone{a: make(map[string][]net.IP), srv: make(map[string][]net.SRV)}
+}
+
+func (z *dnsZone) setA(name string, ips ...string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.a[name] = nil
+	for _, ip := range ips {
+		z.a[name] = append(z.a[name], net.ParseIP(ip))
+	}
+}
+
+func (z *dnsZone) setSRV(name string, records ...net.SRV) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.srv[name] = records
+}
+
+func (z *dnsZone) delete(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	delete(z.a, name)
+	delete(z.srv, name)
+}
+
+func (z *dnsZone) serveUDP(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if resp, err := z.answer(buf[:n]); err == nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func (z *dnsZone) serveTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					var size uint16
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+
+					req := make([]byte, size)
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+
+					resp, err := z.answer(req)
+					if err != nil {
+						return
+					}
+
+					binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+					conn.Write(resp)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func (z *dnsZone) answer(req []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil {
+		return nil, err
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+		Questions: msg.Questions,
+	}
+
+	for _, q := range msg.Questions {
+		name := q.Name.String()
+
+		ips, hasA := z.a[name]
+		records, hasSRV := z.srv[name]
+		if !hasA && !hasSRV {
+			resp.RCode = dnsmessage.RCodeNameError
+			continue
+		}
+
+		header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+
+		switch q.Type {
+		case dnsmessage.TypeA:
+			for _, ip := range ips {
+				r := &dnsmessage.AResource{}
+				copy(r.A[:], ip.To4())
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: r})
+			}
+
+		case dnsmessage.TypeSRV:
+			for _, srv := range records {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.SRVResource{
+					Target: dnsmessage.MustNewName(srv.Target),
+					Port:   srv.Port,
+					Weight: srv.Weight,
+				}})
+			}
+		}
+	}
+
+	return resp.Pack()
+}
+
+func TestDNSServiceDiscovery_HostResolver(t *testing.T) {
+	zone := newDNSZone()
+	zone.setA("peer.example.com.", "169.196.255.253")
+
+	dsd := &DNSServiceDiscovery{Server: zone.serveUDP(t)}
+
+	ips, err := dsd.HostResolver().LookupHost(context.TODO(), "peer.example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"169.196.255.253"}, ips)
 }
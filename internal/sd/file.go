@@ -0,0 +1,146 @@
+package sd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var _ ServiceDiscoverer = (*FileServiceDiscovery)(nil)
+
+// FileServiceDiscovery reads peers from a JSON or YAML file, reloading it
+// whenever it changes. The file contains either a list of peers or an object
+// with a "peers" list, each being "host" or "host:port", e.g.:
+//
+//	peers:
+//	- 10.0.0.1
+//	- 10.0.0.2:8001
+type FileServiceDiscovery struct {
+	Filename string
+	Logger   *zap.Logger
+
+	peerSet
+}
+
+func (fsd *FileServiceDiscovery) Discover(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer fsd.close()
+
+	if fsd.Logger == nil {
+		fsd.Logger = zap.NewNop()
+	}
+
+	fsd.Logger = fsd.Logger.With(zap.String("sd_method", "file"), zap.String("filename", fsd.Filename))
+
+	fsd.Logger.Debug("Starting service discovery")
+	defer fsd.Logger.Debug("Finishing service discovery")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// NOTE: watching the parent directory since editors (and Kubernetes
+	// ConfigMap volumes) replace the file instead of writing to it.
+	if err = watcher.Add(filepath.Dir(fsd.Filename)); err != nil {
+		return err
+	}
+
+	// NOTE: loading the file outside of loop to catch and return possible read or parse errors.
+	if err = fsd.load(ctx); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case evt, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("events channel is closed")
+			}
+
+			if evt.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if err := fsd.load(ctx); err != nil {
+				fsd.Logger.Error("Failed to reload peers file", zap.Error(err))
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("errors channel is closed")
+			}
+
+			fsd.Logger.Error("Failed to watch peers file", zap.Error(err))
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (fsd *FileServiceDiscovery) load(ctx context.Context) error {
+	data, err := os.ReadFile(fsd.Filename)
+	if err != nil {
+		return err
+	}
+
+	peers, err := parsePeersFile(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse peers file: %w", err)
+	}
+
+	fsd.Logger.Debug("Peers file loaded", zap.Stringers("peers", peers))
+
+	fsd.update(ctx, peers)
+
+	return nil
+}
+
+// parsePeersFile accepts both YAML and JSON, as the latter is valid YAML.
+func parsePeersFile(data []byte) ([]Peer, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	if len(node.Content) == 0 { // empty file
+		return nil, nil
+	}
+
+	var addresses []string
+
+	root := node.Content[0]
+	switch root.Kind {
+	case yaml.SequenceNode:
+		if err := root.Decode(&addresses); err != nil {
+			return nil, err
+		}
+
+	case yaml.MappingNode:
+		var doc struct {
+			Peers []string `yaml:"peers"`
+		}
+
+		if err := root.Decode(&doc); err != nil {
+			return nil, err
+		}
+
+		addresses = doc.Peers
+
+	default:
+		return nil, errors.New(`expected a list of peers or an object with a "peers" list`)
+	}
+
+	return ParsePeers(addresses)
+}
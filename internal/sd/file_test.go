@@ -0,0 +1,63 @@
+package sd_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestFileServiceDiscovery_Discover(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "peers.json")
+
+	require.NoError(t, os.WriteFile(filename, []byte(`{"peers": ["10.0.0.1"]}`), 0o644))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	fsd := &FileServiceDiscovery{Filename: filename}
+
+	go func() {
+		assert.NoError(t, fsd.Discover(ctx))
+	}()
+
+	assert.Equal(t, Peer{Host: "10.0.0.1"}, receive(t, fsd.Added()))
+
+	require.NoError(t, os.WriteFile(filename, []byte(`["10.0.0.1", "10.0.0.2:8001"]`), 0o644))
+
+	assert.Equal(t, Peer{Host: "10.0.0.2", Port: 8001}, receive(t, fsd.Added()))
+
+	// replacing the file as editors do
+	tmp := filepath.Join(dir, "peers.yaml.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("peers:\n- 10.0.0.2:8001\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, filename))
+
+	assert.Equal(t, Peer{Host: "10.0.0.1"}, receive(t, fsd.Removed()))
+}
+
+func TestFileServiceDiscovery_Discover_InvalidFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peers.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(`peers: 10.0.0.1`), 0o644))
+
+	err := (&FileServiceDiscovery{Filename: filename}).Discover(context.TODO())
+	assert.ErrorContains(t, err, "failed to parse peers file")
+}
+
+func TestStaticServiceDiscovery_Discover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ssd := &StaticServiceDiscovery{Peers: []Peer{{Host: "10.0.0.1"}}}
+
+	go func() {
+		assert.NoError(t, ssd.Discover(ctx))
+	}()
+
+	assert.Equal(t, Peer{Host: "10.0.0.1"}, receive(t, ssd.Added()))
+}
@@ -0,0 +1,641 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var _ ServiceDiscoverer = (*GossipServiceDiscovery)(nil)
+
+const (
+	DefaultGossipProbeInterval    = time.Second
+	DefaultGossipProbeTimeout     = 300 * time.Millisecond
+	DefaultGossipIndirectProbes   = 3
+	DefaultGossipSuspicionTimeout = 5 * time.Second
+
+	gossipRetransmitMult = 4
+	gossipMaxPiggyback   = 16
+	gossipMaxPacketSize  = 65507
+	gossipSyncPeriods    = 10 // protocol periods between full state exchanges
+)
+
+// GossipServiceDiscovery finds peers through a SWIM-style gossip protocol
+// over UDP: members are probed directly (and indirectly through others when
+// they do not answer), become suspect, and are declared dead after a timeout
+// unless they refute it. Membership changes are piggybacked on the protocol
+// messages, and a full state exchange with a random member happens every few
+// periods to repair what dissemination missed. Peers are reported while they
+// are alive or suspect.
+type GossipServiceDiscovery struct {
+	// BindAddress is the UDP address (host:port) to listen for gossip.
+	BindAddress string
+	// AdvertiseAddress is the gossip address other members use to reach this
+	// one; defaults to the bound address.
+	AdvertiseAddress string
+	// Seeds are gossip addresses of members used to join the cluster.
+	Seeds []string
+	// Port is the port of the cache repository server advertised to peers.
+	Port int
+
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	IndirectProbes   int
+	SuspicionTimeout time.Duration
+
+	Logger *zap.Logger
+
+	peerSet
+
+	conn    net.PacketConn
+	seq     atomic.Uint64
+	changed chan struct{}
+
+	mu         sync.Mutex
+	self       member
+	members    map[string]*memberInfo // by gossip address, self excluded
+	broadcasts []*broadcast
+	acks       map[uint64]chan struct{}
+	probes     []string // probing order, reshuffled on each round
+}
+
+type memberState int
+
+const (
+	stateAlive memberState = iota
+	stateSuspect
+	stateDead
+)
+
+type member struct {
+	Address     string      `json:"address"`
+	Port        int         `json:"port"`
+	State       memberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+type memberInfo struct {
+	member
+	changedAt time.Time
+}
+
+type broadcast struct {
+	member    member
+	transmits int
+}
+
+type gossipMessageType string
+
+const (
+	msgPing    gossipMessageType = "ping"
+	msgPingReq gossipMessageType = "ping-req"
+	msgAck     gossipMessageType = "ack"
+	msgJoin    gossipMessageType = "join"
+)
+
+type gossipMessage struct {
+	Type    gossipMessageType `json:"type"`
+	Seq     uint64            `json:"seq,omitempty"`
+	From    string            `json:"from"`
+	Target  string            `json:"target,omitempty"`
+	Updates []member          `json:"updates,omitempty"`
+}
+
+// Listen binds the gossip socket. It is called by Discover when needed, but
+// may be called before to find out the bound address.
+func (gsd *GossipServiceDiscovery) Listen() error {
+	if gsd.conn != nil {
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", gsd.BindAddress)
+	if err != nil {
+		return err
+	}
+
+	advertise := gsd.AdvertiseAddress
+	if advertise == "" {
+		advertise = conn.LocalAddr().String()
+	}
+
+	host, _, err := net.SplitHostPort(advertise)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		conn.Close()
+		return errors.New("gossip advertise address is required when binding to all interfaces")
+	}
+
+	gsd.conn = conn
+	gsd.self = member{
+		Address: advertise,
+		Port:    gsd.Port,
+		State:   stateAlive,
+		// NOTE: starting from the clock so a restarted member overrides what
+		// others remember about its previous run.
+		Incarnation: uint64(time.Now().UnixNano()),
+	}
+
+	return nil
+}
+
+// Address returns the advertised gossip address, once listening.
+func (gsd *GossipServiceDiscovery) Address() string {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	return gsd.self.Address
+}
+
+func (gsd *GossipServiceDiscovery) Discover(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer gsd.close()
+
+	if gsd.Logger == nil {
+		gsd.Logger = zap.NewNop()
+	}
+
+	gsd.setDefaults()
+
+	if err := gsd.Listen(); err != nil {
+		return err
+	}
+	defer gsd.conn.Close()
+
+	gsd.Logger = gsd.Logger.With(zap.String("sd_method", "gossip"), zap.String("address", gsd.self.Address))
+
+	gsd.Logger.Debug("Starting service discovery", zap.Strings("seeds", gsd.Seeds))
+	defer gsd.Logger.Debug("Finishing service discovery")
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(2)
+	go func() { defer wg.Done(); gsd.receive(ctx) }()
+	go func() { defer wg.Done(); gsd.notify(ctx) }()
+
+	gsd.join()
+
+	tc := time.NewTicker(gsd.ProbeInterval)
+	defer tc.Stop()
+
+	for period := 1; ; period++ {
+		select {
+		case <-tc.C:
+			gsd.reap()
+
+			if period%gossipSyncPeriods == 0 {
+				gsd.sync()
+			}
+
+			gsd.probe(ctx)
+
+		case <-ctx.Done():
+			gsd.leave()
+			return nil
+		}
+	}
+}
+
+func (gsd *GossipServiceDiscovery) setDefaults() {
+	if gsd.ProbeInterval <= 0 {
+		gsd.ProbeInterval = DefaultGossipProbeInterval
+	}
+
+	if gsd.ProbeTimeout <= 0 || gsd.ProbeTimeout >= gsd.ProbeInterval {
+		gsd.ProbeTimeout = DefaultGossipProbeTimeout
+		if gsd.ProbeTimeout >= gsd.ProbeInterval {
+			gsd.ProbeTimeout = gsd.ProbeInterval / 3
+		}
+	}
+
+	if gsd.IndirectProbes <= 0 {
+		gsd.IndirectProbes = DefaultGossipIndirectProbes
+	}
+
+	if gsd.SuspicionTimeout <= 0 {
+		gsd.SuspicionTimeout = DefaultGossipSuspicionTimeout
+	}
+
+	gsd.members = make(map[string]*memberInfo)
+	gsd.acks = make(map[uint64]chan struct{})
+	gsd.changed = make(chan struct{}, 1)
+}
+
+// join announces this member to the seeds, which answer with their view of
+// the cluster.
+func (gsd *GossipServiceDiscovery) join() {
+	for _, seed := range gsd.Seeds {
+		if seed == gsd.Address() {
+			continue
+		}
+
+		gsd.send(seed, gsd.fullState(msgJoin, gsd.seq.Add(1)))
+	}
+}
+
+// sync exchanges the full membership with a random member.
+func (gsd *GossipServiceDiscovery) sync() {
+	gsd.mu.Lock()
+	members := gsd.liveAddresses("")
+	gsd.mu.Unlock()
+
+	if len(members) == 0 {
+		return
+	}
+
+	gsd.send(members[rand.Intn(len(members))], gsd.fullState(msgJoin, gsd.seq.Add(1)))
+}
+
+// leave tells some members this one is going away, so they do not have to
+// wait for the suspicion timeout.
+func (gsd *GossipServiceDiscovery) leave() {
+	gsd.mu.Lock()
+	gsd.self.State = stateDead
+	self := gsd.self
+	targets := gsd.liveAddresses("")
+	gsd.mu.Unlock()
+
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > gsd.IndirectProbes {
+		targets = targets[:gsd.IndirectProbes]
+	}
+
+	for _, target := range targets {
+		gsd.send(target, gossipMessage{Type: msgPing, Seq: gsd.seq.Add(1), From: self.Address, Updates: []member{self}})
+	}
+}
+
+// probe runs one SWIM protocol period against the next member.
+func (gsd *GossipServiceDiscovery) probe(ctx context.Context) {
+	target, ok := gsd.nextProbe()
+	if !ok {
+		gsd.join() // alone, maybe the seeds were not up yet
+		return
+	}
+
+	seq := gsd.seq.Add(1)
+	acked := gsd.await(seq)
+	defer gsd.forget(seq)
+
+	gsd.send(target, gsd.message(msgPing, seq, "", target))
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(gsd.ProbeTimeout):
+	case <-ctx.Done():
+		return
+	}
+
+	gsd.mu.Lock()
+	helpers := gsd.liveAddresses(target)
+	gsd.mu.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > gsd.IndirectProbes {
+		helpers = helpers[:gsd.IndirectProbes]
+	}
+
+	for _, helper := range helpers {
+		gsd.send(helper, gsd.message(msgPingReq, seq, target, helper))
+	}
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(gsd.ProbeInterval - gsd.ProbeTimeout):
+	case <-ctx.Done():
+		return
+	}
+
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	if m, found := gsd.members[target]; found && m.State == stateAlive {
+		gsd.Logger.Debug("Member did not answer, suspecting it", zap.String("member", target))
+		gsd.apply(member{Address: target, Port: m.Port, State: stateSuspect, Incarnation: m.Incarnation})
+	}
+}
+
+// reap declares dead the members suspected for too long and forgets the ones
+// dead for a while.
+func (gsd *GossipServiceDiscovery) reap() {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	now := time.Now()
+	for address, m := range gsd.members {
+		switch {
+		case m.State == stateSuspect && now.Sub(m.changedAt) > gsd.SuspicionTimeout:
+			gsd.Logger.Debug("Suspect member timed out, declaring it dead", zap.String("member", address))
+			gsd.apply(member{Address: address, Port: m.Port, State: stateDead, Incarnation: m.Incarnation})
+
+		case m.State == stateDead && now.Sub(m.changedAt) > 10*gsd.SuspicionTimeout:
+			delete(gsd.members, address)
+		}
+	}
+}
+
+func (gsd *GossipServiceDiscovery) receive(ctx context.Context) {
+	buf := make([]byte, gossipMaxPacketSize)
+
+	for {
+		n, _, err := gsd.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				gsd.Logger.Error("Failed to read gossip message", zap.Error(err))
+				continue
+			}
+			return
+		}
+
+		var msg gossipMessage
+		if err = json.Unmarshal(buf[:n], &msg); err != nil {
+			gsd.Logger.Debug("Ignoring invalid gossip message", zap.Error(err))
+			continue
+		}
+
+		gsd.handle(ctx, msg)
+	}
+}
+
+func (gsd *GossipServiceDiscovery) handle(ctx context.Context, msg gossipMessage) {
+	gsd.mu.Lock()
+	for _, u := range msg.Updates {
+		gsd.apply(u)
+	}
+	gsd.mu.Unlock()
+
+	switch msg.Type {
+	case msgPing:
+		gsd.send(msg.From, gsd.message(msgAck, msg.Seq, "", msg.From))
+
+	case msgJoin:
+		gsd.send(msg.From, gsd.fullState(msgAck, msg.Seq))
+
+	case msgAck:
+		gsd.mu.Lock()
+		acked, found := gsd.acks[msg.Seq]
+		if found {
+			close(acked)
+			delete(gsd.acks, msg.Seq)
+		}
+		gsd.mu.Unlock()
+
+	case msgPingReq:
+		go gsd.probeFor(ctx, msg)
+	}
+}
+
+// probeFor pings a member on behalf of another one, relaying the ack.
+func (gsd *GossipServiceDiscovery) probeFor(ctx context.Context, req gossipMessage) {
+	seq := gsd.seq.Add(1)
+	acked := gsd.await(seq)
+	defer gsd.forget(seq)
+
+	gsd.send(req.Target, gsd.message(msgPing, seq, "", req.Target))
+
+	select {
+	case <-acked:
+		gsd.send(req.From, gsd.message(msgAck, req.Seq, "", req.From))
+	case <-time.After(gsd.ProbeInterval - gsd.ProbeTimeout):
+	case <-ctx.Done():
+	}
+}
+
+// apply merges a membership update, following SWIM's incarnation rules. It
+// must be called holding the lock.
+func (gsd *GossipServiceDiscovery) apply(u member) {
+	if u.Address == gsd.self.Address {
+		if u.State != stateAlive && u.Incarnation >= gsd.self.Incarnation && gsd.self.State == stateAlive {
+			gsd.self.Incarnation = u.Incarnation + 1 // refuting
+			gsd.enqueue(gsd.self)
+		}
+		return
+	}
+
+	current, found := gsd.members[u.Address]
+	if !found {
+		gsd.members[u.Address] = &memberInfo{member: u, changedAt: time.Now()}
+		if u.State != stateDead {
+			gsd.enqueue(u)
+			gsd.signal()
+		}
+		return
+	}
+
+	if !overrides(u, current.member) {
+		return
+	}
+
+	wasLive := current.State != stateDead
+	current.member, current.changedAt = u, time.Now()
+
+	gsd.enqueue(u)
+
+	if wasLive != (u.State != stateDead) {
+		gsd.signal()
+	}
+}
+
+func overrides(u, current member) bool {
+	switch u.State {
+	case stateAlive:
+		return u.Incarnation > current.Incarnation
+	case stateSuspect:
+		return (current.State == stateAlive && u.Incarnation >= current.Incarnation) ||
+			(current.State == stateSuspect && u.Incarnation > current.Incarnation)
+	case stateDead:
+		return current.State != stateDead && u.Incarnation >= current.Incarnation
+	}
+
+	return false
+}
+
+// enqueue schedules an update to be piggybacked, replacing older updates
+// about the same member. It must be called holding the lock.
+func (gsd *GossipServiceDiscovery) enqueue(u member) {
+	for i, b := range gsd.broadcasts {
+		if b.member.Address == u.Address {
+			gsd.broadcasts = append(gsd.broadcasts[:i], gsd.broadcasts[i+1:]...)
+			break
+		}
+	}
+
+	gsd.broadcasts = append(gsd.broadcasts, &broadcast{member: u})
+}
+
+// message builds a protocol message carrying the state of this member plus
+// pending updates. When our view of the recipient is not alive, it is
+// included so the recipient can refute it.
+func (gsd *GossipServiceDiscovery) message(typ gossipMessageType, seq uint64, target, to string) gossipMessage {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	msg := gossipMessage{Type: typ, Seq: seq, From: gsd.self.Address, Target: target, Updates: []member{gsd.self}}
+
+	if m, found := gsd.members[to]; found && m.State != stateAlive {
+		msg.Updates = append(msg.Updates, m.member)
+	}
+
+	sort.SliceStable(gsd.broadcasts, func(i, j int) bool { return gsd.broadcasts[i].transmits < gsd.broadcasts[j].transmits })
+
+	limit := gossipRetransmitMult * int(math.Ceil(math.Log10(float64(len(gsd.members)+2))))
+
+	kept := gsd.broadcasts[:0]
+	for _, b := range gsd.broadcasts {
+		if len(msg.Updates) < gossipMaxPiggyback {
+			msg.Updates = append(msg.Updates, b.member)
+			b.transmits++
+		}
+
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	gsd.broadcasts = kept
+
+	return msg
+}
+
+// fullState builds a message with every known member, including this one.
+func (gsd *GossipServiceDiscovery) fullState(typ gossipMessageType, seq uint64) gossipMessage {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	msg := gossipMessage{Type: typ, Seq: seq, From: gsd.self.Address, Updates: []member{gsd.self}}
+	for _, m := range gsd.members {
+		msg.Updates = append(msg.Updates, m.member)
+	}
+
+	return msg
+}
+
+func (gsd *GossipServiceDiscovery) send(to string, msg gossipMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		gsd.Logger.Error("Failed to encode gossip message", zap.Error(err))
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		gsd.Logger.Debug("Failed to resolve member address", zap.String("member", to), zap.Error(err))
+		return
+	}
+
+	if _, err = gsd.conn.WriteTo(data, addr); err != nil {
+		gsd.Logger.Debug("Failed to send gossip message", zap.String("member", to), zap.Error(err))
+	}
+}
+
+func (gsd *GossipServiceDiscovery) await(seq uint64) <-chan struct{} {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	ch := make(chan struct{})
+	gsd.acks[seq] = ch
+
+	return ch
+}
+
+func (gsd *GossipServiceDiscovery) forget(seq uint64) {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	delete(gsd.acks, seq)
+}
+
+// nextProbe returns the next member to probe, going round-robin over the
+// live members in random order.
+func (gsd *GossipServiceDiscovery) nextProbe() (string, bool) {
+	gsd.mu.Lock()
+	defer gsd.mu.Unlock()
+
+	for len(gsd.probes) > 0 {
+		next := gsd.probes[0]
+		gsd.probes = gsd.probes[1:]
+
+		if m, found := gsd.members[next]; found && m.State != stateDead {
+			return next, true
+		}
+	}
+
+	gsd.probes = gsd.liveAddresses("")
+	if len(gsd.probes) == 0 {
+		return "", false
+	}
+
+	rand.Shuffle(len(gsd.probes), func(i, j int) { gsd.probes[i], gsd.probes[j] = gsd.probes[j], gsd.probes[i] })
+
+	next := gsd.probes[0]
+	gsd.probes = gsd.probes[1:]
+
+	return next, true
+}
+
+// liveAddresses returns the alive or suspect members but except. It must be
+// called holding the lock.
+func (gsd *GossipServiceDiscovery) liveAddresses(except string) (addresses []string) {
+	for address, m := range gsd.members {
+		if address != except && m.State != stateDead {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return
+}
+
+func (gsd *GossipServiceDiscovery) signal() {
+	select {
+	case gsd.changed <- struct{}{}:
+	default:
+	}
+}
+
+// notify reports the live members as peers whenever membership changes.
+func (gsd *GossipServiceDiscovery) notify(ctx context.Context) {
+	for {
+		select {
+		case <-gsd.changed:
+		case <-ctx.Done():
+			return
+		}
+
+		gsd.mu.Lock()
+		var peers []Peer
+		for address, m := range gsd.members {
+			if m.State == stateDead {
+				continue
+			}
+
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
+			}
+
+			peers = append(peers, Peer{Host: host, Port: m.Port})
+		}
+		gsd.mu.Unlock()
+
+		gsd.Logger.Debug("Membership changed", zap.Stringers("peers", peers))
+
+		gsd.update(ctx, peers)
+	}
+}
@@ -0,0 +1,149 @@
+package sd_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestGossipServiceDiscovery_Discover(t *testing.T) {
+	const size = 8
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var seed string
+	nodes := make([]*GossipServiceDiscovery, size)
+	views := make([]*peerView, size)
+	cancels := make([]context.CancelFunc, size)
+
+	for i := range nodes {
+		nodes[i] = &GossipServiceDiscovery{
+			BindAddress:      "127.0.0.1:0",
+			Port:             9000 + i,
+			ProbeInterval:    50 * time.Millisecond,
+			ProbeTimeout:     15 * time.Millisecond,
+			SuspicionTimeout: 300 * time.Millisecond,
+		}
+		require.NoError(t, nodes[i].Listen())
+
+		if seed == "" {
+			seed = nodes[i].Address()
+		} else {
+			nodes[i].Seeds = []string{seed}
+		}
+
+		views[i] = watchPeers(nodes[i])
+
+		var nctx context.Context
+		nctx, cancels[i] = context.WithCancel(ctx)
+
+		go func(gsd *GossipServiceDiscovery) {
+			assert.NoError(t, gsd.Discover(nctx))
+		}(nodes[i])
+	}
+
+	// everyone knows everyone else
+	for i, view := range views {
+		view.eventually(t, size-1, fmt.Sprintf("node %d", i))
+		assert.NotContains(t, view.ids(), Peer{Host: "127.0.0.1", Port: 9000 + i}.ID())
+	}
+
+	// a member leaving gracefully
+	cancels[size-1]()
+
+	for i, view := range views[:size-1] {
+		view.eventually(t, size-2, fmt.Sprintf("node %d after leave", i))
+	}
+
+	// a member which joins and then stops answering
+	crashed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	join := fmt.Sprintf(`{"type": "join", "seq": 1, "from": %q, "updates": [{"address": %q, "port": 9999, "state": 0, "incarnation": 1}]}`,
+		crashed.LocalAddr().String(), crashed.LocalAddr().String())
+
+	addr, err := net.ResolveUDPAddr("udp", seed)
+	require.NoError(t, err)
+
+	_, err = crashed.WriteTo([]byte(join), addr)
+	require.NoError(t, err)
+
+	for i, view := range views[:size-1] {
+		view.eventually(t, size-1, fmt.Sprintf("node %d after join", i))
+		assert.Contains(t, view.ids(), "127.0.0.1:9999")
+	}
+
+	crashed.Close()
+
+	for i, view := range views[:size-1] {
+		view.eventually(t, size-2, fmt.Sprintf("node %d after crash", i))
+		assert.NotContains(t, view.ids(), "127.0.0.1:9999")
+	}
+}
+
+// peerView tracks the peers reported by a discoverer.
+type peerView struct {
+	mu    sync.Mutex
+	peers map[string]Peer
+}
+
+func watchPeers(d ServiceDiscoverer) *peerView {
+	v := &peerView{peers: make(map[string]Peer)}
+
+	go func() {
+		added, removed := d.Added(), d.Removed()
+		for added != nil || removed != nil {
+			select {
+			case p, ok := <-added:
+				if !ok {
+					added = nil
+					continue
+				}
+
+				v.mu.Lock()
+				v.peers[p.ID()] = p
+				v.mu.Unlock()
+
+			case p, ok := <-removed:
+				if !ok {
+					removed = nil
+					continue
+				}
+
+				v.mu.Lock()
+				delete(v.peers, p.ID())
+				v.mu.Unlock()
+			}
+		}
+	}()
+
+	return v
+}
+
+func (v *peerView) ids() (ids []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for id := range v.peers {
+		ids = append(ids, id)
+	}
+
+	return
+}
+
+func (v *peerView) eventually(t *testing.T, size int, msg string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool { return len(v.ids()) == size }, 10*time.Second, 10*time.Millisecond,
+		"%s: expected %d peers, got %s", msg, size, strconv.Quote(fmt.Sprint(v.ids())))
+}
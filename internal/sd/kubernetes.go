@@ -0,0 +1,294 @@
+package sd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var _ ServiceDiscoverer = (*KubernetesServiceDiscovery)(nil)
+
+var errResourceExpired = errors.New("resource version expired")
+
+// KubernetesServiceDiscovery watches the EndpointSlices of a Service, reporting
+// the addresses of ready endpoints as peers.
+type KubernetesServiceDiscovery struct {
+	Service string
+	// Namespace of the Service; defaults to the namespace from Config.
+	Namespace string
+	// Config to reach the API server; defaults to the in-cluster configuration.
+	Config *KubernetesConfig
+	Logger *zap.Logger
+
+	peerSet
+
+	client          *http.Client
+	slices          map[string][]string // ready addresses by EndpointSlice name
+	resourceVersion string
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (ksd *KubernetesServiceDiscovery) Discover(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer ksd.close()
+
+	if ksd.Logger == nil {
+		ksd.Logger = zap.NewNop()
+	}
+
+	if ksd.Config == nil {
+		cfg, err := InClusterConfig()
+		if err != nil {
+			return err
+		}
+
+		ksd.Config = cfg
+	}
+
+	if ksd.Namespace == "" {
+		ksd.Namespace = ksd.Config.Namespace
+	}
+
+	ksd.client = ksd.Config.client()
+
+	ksd.Logger = ksd.Logger.With(zap.String("sd_method", "kubernetes"), zap.String("namespace", ksd.Namespace), zap.String("service", ksd.Service))
+
+	ksd.Logger.Debug("Starting service discovery")
+	defer ksd.Logger.Debug("Finishing service discovery")
+
+	// NOTE: running the first list outside of loop to catch and return possible API errors.
+	if err := ksd.list(ctx); err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for {
+		err := ksd.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err == nil { // server closed the watch, resuming from the last version seen
+			backoff = time.Second
+			continue
+		}
+
+		if !errors.Is(err, errResourceExpired) {
+			ksd.Logger.Error("Failed to watch EndpointSlices", zap.Error(err))
+
+			if !sleep(ctx, &backoff) {
+				return nil
+			}
+		}
+
+		for {
+			if err = ksd.list(ctx); err == nil {
+				break
+			}
+
+			ksd.Logger.Error("Failed to list EndpointSlices", zap.Error(err))
+
+			if !sleep(ctx, &backoff) {
+				return nil
+			}
+		}
+	}
+}
+
+// list fetches all EndpointSlices of the service, keeping the resource
+// version to watch from.
+func (ksd *KubernetesServiceDiscovery) list(ctx context.Context) error {
+	resp, err := ksd.get(ctx, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	ksd.slices = make(map[string][]string)
+	for _, es := range list.Items {
+		ksd.slices[es.Metadata.Name] = readyAddresses(es)
+	}
+
+	ksd.resourceVersion = list.Metadata.ResourceVersion
+
+	ksd.notify(ctx)
+
+	return nil
+}
+
+func (ksd *KubernetesServiceDiscovery) watch(ctx context.Context) error {
+	resp, err := ksd.get(ctx, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {ksd.resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var evt watchEvent
+		if err = dec.Decode(&evt); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		if evt.Type == "ERROR" {
+			var st status
+			if err = json.Unmarshal(evt.Object, &st); err == nil && st.Code == http.StatusGone {
+				return errResourceExpired
+			}
+
+			return fmt.Errorf("watch error: %s", st.Message)
+		}
+
+		var es endpointSlice
+		if err = json.Unmarshal(evt.Object, &es); err != nil {
+			return err
+		}
+
+		ksd.resourceVersion = es.Metadata.ResourceVersion
+
+		switch evt.Type {
+		case "ADDED", "MODIFIED":
+			ksd.slices[es.Metadata.Name] = readyAddresses(es)
+		case "DELETED":
+			delete(ksd.slices, es.Metadata.Name)
+		default: // e.g. BOOKMARK
+			continue
+		}
+
+		ksd.notify(ctx)
+	}
+}
+
+func (ksd *KubernetesServiceDiscovery) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+ksd.Service)
+
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", ksd.Config.Host, url.PathEscape(ksd.Namespace), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if err = ksd.Config.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := ksd.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errResourceExpired
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code from API server: %d: %s", resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+func (ksd *KubernetesServiceDiscovery) notify(ctx context.Context) {
+	var peers []Peer
+	for _, addresses := range ksd.slices {
+		for _, address := range addresses {
+			peers = append(peers, Peer{Host: address})
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Host < peers[j].Host })
+
+	ksd.Logger.Debug("EndpointSlices changed", zap.Stringers("peers", peers))
+
+	ksd.update(ctx, peers)
+}
+
+// sleep waits for backoff, doubling it up to a limit. It returns false when
+// ctx is done meanwhile.
+func sleep(ctx context.Context, backoff *time.Duration) bool {
+	select {
+	case <-time.After(*backoff):
+	case <-ctx.Done():
+		return false
+	}
+
+	if *backoff *= 2; *backoff > 30*time.Second {
+		*backoff = 30 * time.Second
+	}
+
+	return true
+}
+
+// readyAddresses returns the addresses of ready endpoints. As in the API
+// conventions, an unknown readiness is interpreted as ready.
+func readyAddresses(es endpointSlice) (addresses []string) {
+	for _, e := range es.Endpoints {
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+
+		addresses = append(addresses, e.Addresses...)
+	}
+
+	return
+}
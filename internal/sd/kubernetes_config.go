@@ -0,0 +1,225 @@
+package sd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesConfig holds what is needed to talk to the Kubernetes API server.
+type KubernetesConfig struct {
+	Host      string // e.g. https://10.0.0.1:443
+	Namespace string
+	Token     string
+	TokenFile string // re-read on each request, since bound tokens are rotated
+	TLS       *tls.Config
+}
+
+// InClusterConfig builds the configuration from the service account mounted
+// into the pod.
+func InClusterConfig() (*KubernetesConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a Kubernetes cluster")
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in service account CA")
+	}
+
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesConfig{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(namespace)),
+		TokenFile: filepath.Join(serviceAccountDir, "token"),
+		TLS:       &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// LoadKubeconfig builds the configuration from the current context of a
+// kubeconfig file. Only token and client certificate authentication are
+// supported.
+func LoadKubeconfig(filename string) (*KubernetesConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var kc kubeconfig
+	if err = yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	cfg := &KubernetesConfig{Namespace: "default", TLS: &tls.Config{MinVersion: tls.VersionTLS12}}
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				cfg.Namespace = c.Context.Namespace
+			}
+		}
+	}
+
+	if clusterName == "" {
+		return nil, fmt.Errorf("context %q not found in kubeconfig", kc.CurrentContext)
+	}
+
+	base := filepath.Dir(filename)
+
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+
+		cfg.Host = strings.TrimSuffix(c.Cluster.Server, "/")
+		cfg.TLS.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify // #nosec G402 -- explicitly requested by kubeconfig
+
+		ca, err := dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, base)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ca) > 0 {
+			cfg.TLS.RootCAs = x509.NewCertPool()
+			if !cfg.TLS.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificates found in kubeconfig certificate authority")
+			}
+		}
+	}
+
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		cfg.Token = u.User.Token
+		if u.User.TokenFile != "" {
+			cfg.TokenFile = resolvePath(base, u.User.TokenFile)
+		}
+
+		cert, err := dataOrFile(u.User.ClientCertificateData, u.User.ClientCertificate, base)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := dataOrFile(u.User.ClientKeyData, u.User.ClientKey, base)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(cert) > 0 && len(key) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.TLS.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	return cfg, nil
+}
+
+func (kc *KubernetesConfig) client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = kc.TLS
+
+	return &http.Client{Transport: transport}
+}
+
+func (kc *KubernetesConfig) authorize(req *http.Request) error {
+	token := kc.Token
+	if kc.TokenFile != "" {
+		data, err := os.ReadFile(kc.TokenFile)
+		if err != nil {
+			return err
+		}
+
+		token = strings.TrimSpace(string(data))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
+
+func dataOrFile(data, filename, base string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if filename != "" {
+		return os.ReadFile(resolvePath(base, filename))
+	}
+
+	return nil, nil
+}
+
+func resolvePath(base, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+
+	return filepath.Join(base, filename)
+}
@@ -0,0 +1,114 @@
+package sd_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+const endpointSlicesPath = "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices"
+
+func TestKubernetesServiceDiscovery_Discover(t *testing.T) {
+	events := make(chan string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, endpointSlicesPath, r.URL.Path)
+		assert.Equal(t, "kubernetes.io/service-name=my-nginx-units", r.URL.Query().Get("labelSelector"))
+		assert.Equal(t, "Bearer my-token", r.Header.Get("Authorization"))
+
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"metadata": {"name": "my-nginx-units-abc", "resourceVersion": "9"}, "endpoints": [
+					{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+					{"addresses": ["10.0.0.2"], "conditions": {"ready": false}}
+				]}
+			]}`)
+			return
+		}
+
+		assert.Equal(t, "10", r.URL.Query().Get("resourceVersion"))
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case evt := <-events:
+				fmt.Fprintln(w, evt)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ksd := &KubernetesServiceDiscovery{
+		Service: "my-nginx-units",
+		Config:  &KubernetesConfig{Host: server.URL, Namespace: "default", Token: "my-token"},
+	}
+
+	go func() {
+		assert.NoError(t, ksd.Discover(ctx))
+	}()
+
+	assert.Equal(t, Peer{Host: "10.0.0.1"}, receive(t, ksd.Added()))
+
+	// 10.0.0.2 becomes ready
+	events <- `{"type": "MODIFIED", "object": {"metadata": {"name": "my-nginx-units-abc", "resourceVersion": "11"}, "endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": true}}
+	]}}`
+
+	assert.Equal(t, Peer{Host: "10.0.0.2"}, receive(t, ksd.Added()))
+
+	// 10.0.0.1 is terminating
+	events <- `{"type": "MODIFIED", "object": {"metadata": {"name": "my-nginx-units-abc", "resourceVersion": "12"}, "endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": false}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": true}}
+	]}}`
+
+	assert.Equal(t, Peer{Host: "10.0.0.1"}, receive(t, ksd.Removed()))
+
+	events <- `{"type": "DELETED", "object": {"metadata": {"name": "my-nginx-units-abc", "resourceVersion": "13"}}}`
+
+	assert.Equal(t, Peer{Host: "10.0.0.2"}, receive(t, ksd.Removed()))
+}
+
+func TestKubernetesServiceDiscovery_Discover_Unauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"kind": "Status", "code": 401}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	ksd := &KubernetesServiceDiscovery{
+		Service: "my-nginx-units",
+		Config:  &KubernetesConfig{Host: server.URL, Namespace: "default"},
+	}
+
+	err := ksd.Discover(context.TODO())
+	assert.ErrorContains(t, err, "401")
+}
+
+func receive(t *testing.T, ch <-chan Peer) Peer {
+	t.Helper()
+
+	select {
+	case peer := <-ch:
+		return peer
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for peer")
+		return Peer{}
+	}
+}
@@ -0,0 +1,72 @@
+package sd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Peer is a discovered instance of the sidecar.
+type Peer struct {
+	Host string // IP address or host name
+	// Port where the peer listens; zero means the port configured locally.
+	Port   int
+	Weight uint16
+}
+
+// ParsePeer parses either "host" or "host:port".
+func ParsePeer(s string) (Peer, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil { // no port at all
+		if ip := net.ParseIP(s); ip != nil || !strings.Contains(s, ":") {
+			return Peer{Host: s}, nil
+		}
+
+		return Peer{}, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return Peer{}, fmt.Errorf("invalid port in peer address %q", s)
+	}
+
+	return Peer{Host: host, Port: p}, nil
+}
+
+// ParsePeers parses a list of "host" or "host:port" addresses.
+func ParsePeers(addresses []string) ([]Peer, error) {
+	peers := make([]Peer, 0, len(addresses))
+	for _, address := range addresses {
+		peer, err := ParsePeer(address)
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// ID identifies the peer, regardless of its weight.
+func (p Peer) ID() string {
+	if p.Port == 0 {
+		return p.Host
+	}
+
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+}
+
+// Address returns the host:port to connect to the peer, falling back to
+// defaultPort when the peer does not have its own.
+func (p Peer) Address(defaultPort int) string {
+	port := p.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
+	return net.JoinHostPort(p.Host, strconv.Itoa(port))
+}
+
+func (p Peer) String() string { return p.ID() }
@@ -0,0 +1,36 @@
+package sd_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+)
+
+func TestParsePeer(t *testing.T) {
+	tests := map[string]Peer{
+		"10.0.0.1":            {Host: "10.0.0.1"},
+		"10.0.0.1:8001":       {Host: "10.0.0.1", Port: 8001},
+		"my-peer.example.com": {Host: "my-peer.example.com"},
+		"my-peer:8001":        {Host: "my-peer", Port: 8001},
+		"fd00::1":             {Host: "fd00::1"},
+		"[fd00::1]:8001":      {Host: "fd00::1", Port: 8001},
+	}
+
+	for address, expected := range tests {
+		peer, err := ParsePeer(address)
+		require.NoError(t, err, address)
+		assert.Equal(t, expected, peer, address)
+	}
+
+	_, err := ParsePeer("my-peer:http")
+	assert.Error(t, err)
+}
+
+func TestPeer_Address(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:8000", Peer{Host: "10.0.0.1"}.Address(8000))
+	assert.Equal(t, "10.0.0.1:8001", Peer{Host: "10.0.0.1", Port: 8001}.Address(8000))
+	assert.Equal(t, "[fd00::1]:8000", Peer{Host: "fd00::1"}.Address(8000))
+}
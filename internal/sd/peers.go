@@ -0,0 +1,99 @@
+package sd
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// peerSet keeps the peers currently known by a discoverer, notifying the
+// differences on every update through the added and removed channels.
+type peerSet struct {
+	added   chan Peer
+	removed chan Peer
+
+	mu      sync.Mutex
+	current map[string]Peer // by ID
+	o       sync.Once
+}
+
+func (ps *peerSet) Added() <-chan Peer {
+	ps.init()
+	return ps.added
+}
+
+func (ps *peerSet) Removed() <-chan Peer {
+	ps.init()
+	return ps.removed
+}
+
+// Peers returns the current peers, sorted by ID.
+func (ps *peerSet) Peers() []Peer {
+	ps.init()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers := make([]Peer, 0, len(ps.current))
+	for _, peer := range ps.current {
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID() < peers[j].ID() })
+
+	return peers
+}
+
+// update replaces the current peers by the observed ones, sending the added
+// and removed peers on the channels. A peer whose attributes changed (e.g.
+// weight) is removed and added back. It gives up when ctx is done.
+func (ps *peerSet) update(ctx context.Context, observed []Peer) {
+	ps.init()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	next := make(map[string]Peer, len(observed))
+	for _, peer := range observed {
+		next[peer.ID()] = peer
+	}
+
+	for id, peer := range ps.current {
+		if p, found := next[id]; found && p == peer {
+			continue
+		}
+
+		select {
+		case ps.removed <- peer:
+			delete(ps.current, id)
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for id, peer := range next {
+		if _, found := ps.current[id]; found {
+			continue
+		}
+
+		select {
+		case ps.added <- peer:
+			ps.current[id] = peer
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ps *peerSet) close() {
+	ps.init()
+	close(ps.added)
+	close(ps.removed)
+}
+
+func (ps *peerSet) init() {
+	ps.o.Do(func() {
+		ps.added, ps.removed = make(chan Peer), make(chan Peer)
+		ps.current = make(map[string]Peer)
+	})
+}
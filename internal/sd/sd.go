@@ -3,7 +3,7 @@ package sd
 import "context"
 
 type ServiceDiscoverer interface {
-	Added() <-chan string
-	Removed() <-chan string
+	Added() <-chan Peer
+	Removed() <-chan Peer
 	Discover(ctx context.Context) error
 }
@@ -0,0 +1,37 @@
+package sd
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+var _ ServiceDiscoverer = (*StaticServiceDiscovery)(nil)
+
+// StaticServiceDiscovery reports a fixed list of peers.
+type StaticServiceDiscovery struct {
+	Peers  []Peer
+	Logger *zap.Logger
+
+	peerSet
+}
+
+func (ssd *StaticServiceDiscovery) Discover(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer ssd.close()
+
+	if ssd.Logger == nil {
+		ssd.Logger = zap.NewNop()
+	}
+
+	ssd.Logger.Debug("Starting service discovery", zap.String("sd_method", "static"), zap.Stringers("peers", ssd.Peers))
+	defer ssd.Logger.Debug("Finishing service discovery", zap.String("sd_method", "static"))
+
+	ssd.update(ctx, ssd.Peers)
+
+	<-ctx.Done()
+	return nil
+}
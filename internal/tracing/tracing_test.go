@@ -0,0 +1,32 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+
+	. "github.com/nettoclaudio/nginx-p2p-cache/internal/tracing"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.TODO()
+
+	shutdown, err := Setup(ctx, Config{Exporter: ExporterNone})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(ctx))
+
+	_, err = Setup(ctx, Config{Exporter: "jaeger"})
+	assert.Error(t, err)
+
+	shutdown, err = Setup(ctx, Config{Exporter: ExporterStdout, SampleRatio: 1, Attributes: map[string]string{"peer.address": "10.0.0.1:8000"}})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(ctx, "span")
+	assert.True(t, span.SpanContext().IsSampled())
+	span.End()
+
+	assert.NoError(t, shutdown(ctx))
+}
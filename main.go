@@ -2,42 +2,139 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/bloom"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/metrics"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/mtls"
 	"github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
 	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
 	pb "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository/v1"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/ring"
 	"github.com/nettoclaudio/nginx-p2p-cache/internal/sd"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/tracing"
 )
 
 var cfg struct {
 	CacheDir                         string
+	CacheLevels                      string
+	NginxConfig                      string
+	CacheZone                        string
 	ServiceDiscoveryMethod           string
 	ServiceDiscoveryDNS              string
 	ServiceDiscoveryDNSQueryInterval time.Duration
 	Port                             int
+	ReplicationMaxConcurrency        int
+	ReplicationMaxBytesPerCycle      int64
+	ReplicationFactor                int
+	ReplicationMinTTL                time.Duration
+	TombstoneTTL                     time.Duration
+	ReplicationVirtualNodes          int
+	AdvertiseAddress                 string
+	DigestFalsePositiveRate          float64
+	FallbackAddress                  string
+	FallbackKeyHeader                string
+	FallbackZoneHeader               string
+	AdminAddress                     string
+	AdminTokenFile                   string
+	WarmUpTimeout                    time.Duration
+	WarmUpBytes                      int64
+	HandOffTimeout                   time.Duration
+	TLSCertFile                      string
+	TLSKeyFile                       string
+	TLSCAFile                        string
+	TLSAllowedSANs                   string
+	TLSAllowedSPIFFEIDs              string
+	TracingExporter                  string
+	TracingOTLPEndpoint              string
+	TracingOTLPInsecure              bool
+	TracingSampleRatio               float64
+	Zones                            zoneFlags
 	ServiceDiscoveryDNSDisableIPv6   bool
+	ServiceDiscoveryDNSSRV           bool
+	ServiceDiscoveryDNSServer        string
+	ServiceDiscoveryDNSTCP           bool
+	ServiceDiscoveryDNSTimeout       time.Duration
+	ServiceDiscoveryDNSDisableSearch bool
+	ServiceDiscoveryK8sService       string
+	ServiceDiscoveryK8sNamespace     string
+	ServiceDiscoveryK8sKubeconfig    string
+	ServiceDiscoveryStaticPeers      string
+	ServiceDiscoveryFile             string
+	ServiceDiscoveryGossipBind       string
+	ServiceDiscoveryGossipAdvertise  string
+	ServiceDiscoveryGossipSeeds      string
 	Debug                            bool
 }
 
 func main() {
 	flag.StringVar(&cfg.CacheDir, "cache-dir", "", "Nginx cache directory")
-	flag.StringVar(&cfg.ServiceDiscoveryMethod, "service-discovery-method", "dns", "Method used to discover peers (allowed methods are: \"dns\")")
+	flag.StringVar(&cfg.CacheLevels, "cache-levels", "", "Levels of the Nginx cache directory, as in proxy_cache_path (e.g. \"1:2\")")
+	flag.StringVar(&cfg.NginxConfig, "nginx-config", "", "Path to the Nginx configuration file, used to discover the cache directory and levels from proxy_cache_path")
+	flag.StringVar(&cfg.CacheZone, "cache-zone", "", "Comma-separated names (keys_zone) of the cache zones to share from the Nginx configuration (defaults to all of them)")
+	flag.Var(&cfg.Zones, "zone", "Cache zone settings as comma-separated key=value pairs: name, dir, levels, replication (owned, all or none), factor and namespace (may be repeated; overrides the Nginx configuration)")
+	flag.StringVar(&cfg.ServiceDiscoveryMethod, "service-discovery-method", "dns", "Method used to discover peers (allowed methods are: \"dns\", \"kubernetes\", \"static\", \"file\", \"gossip\")")
 	flag.StringVar(&cfg.ServiceDiscoveryDNS, "service-discovery-dns", "", "Domain name used to discover peers")
 	flag.DurationVar(&cfg.ServiceDiscoveryDNSQueryInterval, "service-discovery-dns-query-interval", time.Second, "Interval between consecutive DNS queries")
 	flag.BoolVar(&cfg.ServiceDiscoveryDNSDisableIPv6, "service-discovery-dns-disable-ipv6", false, "Whether should disable AAAA queries")
+	flag.StringVar(&cfg.ServiceDiscoveryDNSServer, "service-discovery-dns-server", "", "Address (host:port) of the DNS server used to discover peers (defaults to the system resolver)")
+	flag.BoolVar(&cfg.ServiceDiscoveryDNSTCP, "service-discovery-dns-tcp", false, "Whether should send DNS queries over TCP instead of UDP")
+	flag.DurationVar(&cfg.ServiceDiscoveryDNSTimeout, "service-discovery-dns-timeout", 5*time.Second, "Timeout of each DNS query")
+	flag.BoolVar(&cfg.ServiceDiscoveryDNSDisableSearch, "service-discovery-dns-disable-search", false, "Whether should treat the domain as fully qualified, skipping the search domains")
+	flag.BoolVar(&cfg.ServiceDiscoveryDNSSRV, "service-discovery-dns-srv", false, "Whether should look up SRV records, using the port of each record to reach peers")
+	flag.StringVar(&cfg.ServiceDiscoveryK8sService, "service-discovery-kubernetes-service", "", "Name of the Kubernetes Service whose EndpointSlices are watched to discover peers")
+	flag.StringVar(&cfg.ServiceDiscoveryK8sNamespace, "service-discovery-kubernetes-namespace", "", "Namespace of the Kubernetes Service (defaults to the pod's namespace)")
+	flag.StringVar(&cfg.ServiceDiscoveryK8sKubeconfig, "service-discovery-kubernetes-kubeconfig", "", "Path to a kubeconfig file (defaults to the in-cluster service account)")
+	flag.StringVar(&cfg.ServiceDiscoveryStaticPeers, "service-discovery-static-peers", "", "Comma-separated list of peer addresses (\"host\" or \"host:port\")")
+	flag.StringVar(&cfg.ServiceDiscoveryFile, "service-discovery-file", "", "Path to a JSON or YAML file listing the peer addresses (reloaded on changes)")
+	flag.StringVar(&cfg.ServiceDiscoveryGossipBind, "service-discovery-gossip-bind-address", ":7946", "UDP address to listen for gossip")
+	flag.StringVar(&cfg.ServiceDiscoveryGossipAdvertise, "service-discovery-gossip-advertise-address", "", "Gossip address (host:port) advertised to other members (required when binding to all interfaces)")
+	flag.StringVar(&cfg.ServiceDiscoveryGossipSeeds, "service-discovery-gossip-seeds", "", "Comma-separated list of gossip addresses used to join the cluster")
 	flag.BoolVar(&cfg.Debug, "debug", false, "Whether should run in debug mode")
 	flag.IntVar(&cfg.Port, "port", 8000, "Server TCP port")
+	flag.IntVar(&cfg.ReplicationMaxConcurrency, "replication-max-concurrency", nginx.DefaultMaxConcurrentFetches, "Maximum number of cache entries fetched from peers at once")
+	flag.Int64Var(&cfg.ReplicationMaxBytesPerCycle, "replication-max-bytes-per-cycle", nginx.DefaultMaxBytesPerCycle, "Maximum number of bytes fetched from peers on each replication cycle")
+	flag.DurationVar(&cfg.ReplicationMinTTL, "replication-min-ttl", nginx.DefaultMinRemainingTTL, "Minimum remaining time to live of the cache entries fetched from peers")
+	flag.DurationVar(&cfg.TombstoneTTL, "tombstone-ttl", cr.DefaultTombstoneTTL, "How long cache entries deleted on purpose (e.g. purged) are kept from being replicated back from peers")
+	flag.IntVar(&cfg.ReplicationFactor, "replication-factor", 2, "Number of nodes owning each cache entry (0 means every node replicates every entry)")
+	flag.IntVar(&cfg.ReplicationVirtualNodes, "replication-virtual-nodes", ring.DefaultVirtualNodes, "Number of virtual nodes each node takes on the consistent hashing ring")
+	flag.StringVar(&cfg.AdvertiseAddress, "advertise-address", "", "Address (host or host:port) peers use to reach this node (defaults to the first non-loopback IP address)")
+	flag.Float64Var(&cfg.DigestFalsePositiveRate, "digest-false-positive-rate", bloom.DefaultFalsePositiveRate, "False positive rate of the Bloom filters used to look up which peer holds an entry")
+	flag.StringVar(&cfg.FallbackAddress, "fallback-address", "", "Address of the HTTP server nginx may use as upstream to fetch cache misses from peers (disabled when empty)")
+	flag.StringVar(&cfg.FallbackKeyHeader, "fallback-key-header", nginx.DefaultCacheKeyHeader, "Request header carrying the cache key (proxy_cache_key) on the fallback server")
+	flag.StringVar(&cfg.FallbackZoneHeader, "fallback-zone-header", nginx.DefaultCacheZoneHeader, "Request header carrying the cache zone name on the fallback server (optional with a single zone)")
+	flag.StringVar(&cfg.AdminAddress, "admin-address", "", "Address of the admin HTTP server, serving /peers, /entries, /healthz, /readyz, /purge and /metrics (disabled when empty; /peers, /entries and /purge answer loopback clients only, see -admin-token-file)")
+	flag.StringVar(&cfg.AdminTokenFile, "admin-token-file", "", "Path to a file holding the bearer token required by /peers, /entries and /purge from clients other than loopback ones (defaults to loopback clients only)")
+	flag.DurationVar(&cfg.WarmUpTimeout, "warm-up-timeout", nginx.DefaultWarmUpTimeout, "Maximum time spent pulling entries from peers on startup before reporting ready on /readyz (0 disables the warm-up)")
+	flag.Int64Var(&cfg.WarmUpBytes, "warm-up-bytes", 0, "Number of bytes pulled from peers on startup, the hottest entries first, before reporting ready (0 means every entry this node should hold)")
+	flag.DurationVar(&cfg.HandOffTimeout, "hand-off-timeout", nginx.DefaultHandOffTimeout, "Maximum time spent on termination making peers pull the entries only this node holds (0 disables the hand-off)")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert-file", "", "Path to the PEM certificate presented to peers, enabling mutual TLS between them (reloaded on changes)")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key-file", "", "Path to the PEM private key of the TLS certificate")
+	flag.StringVar(&cfg.TLSCAFile, "tls-ca-file", "", "Path to the PEM bundle of the certificate authorities peer certificates are verified by")
+	flag.StringVar(&cfg.TLSAllowedSANs, "tls-allowed-sans", "", "Comma-separated DNS names (\"*.\" matches a single label), IP addresses and URIs peer certificates may have (defaults to any)")
+	flag.StringVar(&cfg.TLSAllowedSPIFFEIDs, "tls-allowed-spiffe-ids", "", "Comma-separated SPIFFE IDs (or trust domains, e.g. \"spiffe://example.org\") peer certificates may have (defaults to any)")
+	flag.StringVar(&cfg.TracingExporter, "tracing-exporter", tracing.ExporterNone, "Where to export OpenTelemetry traces (allowed exporters are: \"otlp\", \"stdout\"; disabled when empty)")
+	flag.StringVar(&cfg.TracingOTLPEndpoint, "tracing-otlp-endpoint", "", "Address (host:port) of the OTLP gRPC collector (defaults to the OTEL_EXPORTER_OTLP_* environment variables, or localhost:4317)")
+	flag.BoolVar(&cfg.TracingOTLPInsecure, "tracing-otlp-insecure", false, "Whether should connect to the OTLP collector without TLS")
+	flag.Float64Var(&cfg.TracingSampleRatio, "tracing-sample-ratio", 1, "Fraction of the traces started by this node which are recorded")
 	flag.Parse()
 
 	logger := zap.Must(zap.NewProduction())
@@ -45,6 +142,60 @@ func main() {
 		logger = zap.Must(zap.NewDevelopment())
 	}
 
+	discoverer, err := newServiceDiscoverer(logger)
+	if err != nil {
+		logger.Fatal("Failed to set up service discovery", zap.String("method", cfg.ServiceDiscoveryMethod), zap.Error(err))
+	}
+
+	zones, err := newZones(logger)
+	if err != nil {
+		logger.Fatal("Failed to set up cache zones", zap.Error(err))
+	}
+
+	self, err := advertiseAddress()
+	if err != nil {
+		logger.Fatal("Failed to determine the advertise address", zap.Error(err))
+	}
+
+	var certs *mtls.Certificates
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSCAFile != "" {
+		certs = &mtls.Certificates{
+			CertFile:         cfg.TLSCertFile,
+			KeyFile:          cfg.TLSKeyFile,
+			CAFile:           cfg.TLSCAFile,
+			AllowedSANs:      splitList(cfg.TLSAllowedSANs),
+			AllowedSPIFFEIDs: splitList(cfg.TLSAllowedSPIFFEIDs),
+			Logger:           logger,
+		}
+
+		if err = certs.Load(); err != nil {
+			logger.Fatal("Failed to load TLS certificates", zap.Error(err))
+		}
+	}
+
+	var adminToken string
+	if cfg.AdminTokenFile != "" {
+		b, err := os.ReadFile(cfg.AdminTokenFile)
+		if err != nil {
+			logger.Fatal("Failed to read the admin token", zap.Error(err))
+		}
+
+		if adminToken = strings.TrimSpace(string(b)); adminToken == "" {
+			logger.Fatal("Admin token file is empty", zap.String("file", cfg.AdminTokenFile))
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.TracingExporter,
+		Endpoint:    cfg.TracingOTLPEndpoint,
+		Insecure:    cfg.TracingOTLPInsecure,
+		SampleRatio: cfg.TracingSampleRatio,
+		Attributes:  map[string]string{"peer.address": self},
+	})
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+
 	address := fmt.Sprintf(":%d", cfg.Port)
 
 	l, err := net.Listen("tcp", address)
@@ -64,27 +215,75 @@ func main() {
 
 	eg, egctx := errgroup.WithContext(ctx)
 
+	cm := &nginx.CacheManager{
+		Discoverer:              discoverer,
+		Zones:                   zones,
+		Interval:                time.Minute,
+		Logger:                  logger,
+		Port:                    cfg.Port,
+		MaxConcurrentFetches:    cfg.ReplicationMaxConcurrency,
+		MaxBytesPerCycle:        cfg.ReplicationMaxBytesPerCycle,
+		MinRemainingTTL:         cfg.ReplicationMinTTL,
+		Self:                    self,
+		VirtualNodes:            cfg.ReplicationVirtualNodes,
+		DigestFalsePositiveRate: cfg.DigestFalsePositiveRate,
+		WarmUpTimeout:           cfg.WarmUpTimeout,
+		WarmUpBytes:             cfg.WarmUpBytes,
+	}
+
+	if dsd, ok := discoverer.(*sd.DNSServiceDiscovery); ok {
+		cm.Resolver = dsd.HostResolver()
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), metrics.UnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), metrics.StreamServerInterceptor),
+	}
+
+	if certs != nil {
+		cm.TransportCredentials = credentials.NewTLS(certs.ClientConfig())
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(certs.ServerConfig())))
+
+		eg.Go(func() error { return certs.Watch(egctx) })
+	}
+
 	eg.Go(func() error {
 		select {
 		case <-stop:
 			logger.Info("Received a termination signal...")
+
+			// NOTE: peers pull the handed off entries from this node, so its
+			// servers are only stopped afterwards.
+			if cfg.HandOffTimeout > 0 {
+				hctx, hcancel := context.WithTimeout(ctx, cfg.HandOffTimeout)
+				cm.HandOff(hctx)
+				hcancel()
+			}
+
 			cancel()
+
+		case <-egctx.Done(): // some other task failed
 		}
 		return nil
 	})
 
-	watcher := &cr.CacheWatcher{
-		Directory: cfg.CacheDir,
-		Logger:    logger,
+	server := &pb.Server{Logger: logger, Zones: make(map[string]*cr.CacheWatcher), Peers: cm, Receiver: cm}
+	if len(zones) == 1 {
+		server.Cache = zones[0].Watcher
 	}
 
-	eg.Go(func() error { return watcher.Watch(egctx) })
+	for _, z := range zones {
+		watcher := z.Watcher
+		eg.Go(func() error { return watcher.Watch(egctx) })
+
+		server.Zones[z.Namespace] = watcher
+	}
 
-	s := grpc.NewServer()
-	pb.RegisterCacheRepositoryServer(s, &pb.Server{Logger: logger, Cache: watcher})
+	s := grpc.NewServer(serverOpts...)
+	pb.RegisterCacheRepositoryServer(s, server)
 
 	eg.Go(func() error {
-		<-ctx.Done()
+		<-egctx.Done()
 		logger.Info("Finishing web server...")
 		s.GracefulStop()
 		return nil
@@ -95,23 +294,164 @@ func main() {
 		return s.Serve(l)
 	})
 
-	eg.Go(func() error {
-		cm := &nginx.CacheManager{
-			Discoverer: &sd.DNSServiceDiscovery{
-				Domain:      cfg.ServiceDiscoveryDNS,
-				Interval:    cfg.ServiceDiscoveryDNSQueryInterval,
-				DisableIPv6: cfg.ServiceDiscoveryDNSDisableIPv6,
-				Logger:      logger,
-			},
-			Watcher:  watcher,
-			Interval: time.Minute,
-			Logger:   logger,
-			Port:     cfg.Port,
+	prometheus.MustRegister(cm)
+
+	eg.Go(func() error { return cm.Reconcile(egctx) })
+
+	if cfg.FallbackAddress != "" {
+		fallback := &http.Server{
+			Addr:              cfg.FallbackAddress,
+			Handler:           &nginx.FallbackHandler{Manager: cm, KeyHeader: cfg.FallbackKeyHeader, ZoneHeader: cfg.FallbackZoneHeader, Logger: logger},
+			ReadHeaderTimeout: 10 * time.Second,
 		}
-		return cm.Reconcile(egctx)
-	})
 
-	if err := eg.Wait(); err != nil {
+		eg.Go(func() error {
+			<-egctx.Done()
+			logger.Info("Finishing fallback server...")
+			return fallback.Shutdown(context.Background())
+		})
+
+		eg.Go(func() error {
+			logger.Info("Starting fallback server", zap.String("address", cfg.FallbackAddress))
+			if err := fallback.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	if cfg.AdminAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/", &nginx.AdminHandler{Manager: cm, Server: server, Logger: logger, Token: adminToken})
+		mux.Handle("/metrics", promhttp.Handler())
+
+		admin := &http.Server{
+			Addr:              cfg.AdminAddress,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		eg.Go(func() error {
+			<-egctx.Done()
+			logger.Info("Finishing admin server...")
+			return admin.Shutdown(context.Background())
+		})
+
+		eg.Go(func() error {
+			logger.Info("Starting admin server", zap.String("address", cfg.AdminAddress))
+			if err := admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	err = eg.Wait()
+
+	if serr := shutdownTracing(context.Background()); serr != nil {
+		logger.Error("Failed to flush traces", zap.Error(serr))
+	}
+
+	if err != nil {
 		logger.Fatal("Something went wrong :(", zap.Error(err))
 	}
 }
+
+func newServiceDiscoverer(logger *zap.Logger) (sd.ServiceDiscoverer, error) {
+	switch cfg.ServiceDiscoveryMethod {
+	case "dns":
+		return &sd.DNSServiceDiscovery{
+			Domain:        cfg.ServiceDiscoveryDNS,
+			Interval:      cfg.ServiceDiscoveryDNSQueryInterval,
+			DisableIPv6:   cfg.ServiceDiscoveryDNSDisableIPv6,
+			SRV:           cfg.ServiceDiscoveryDNSSRV,
+			Server:        cfg.ServiceDiscoveryDNSServer,
+			UseTCP:        cfg.ServiceDiscoveryDNSTCP,
+			Timeout:       cfg.ServiceDiscoveryDNSTimeout,
+			DisableSearch: cfg.ServiceDiscoveryDNSDisableSearch,
+			Logger:        logger,
+		}, nil
+
+	case "kubernetes":
+		var kc *sd.KubernetesConfig
+		if cfg.ServiceDiscoveryK8sKubeconfig != "" {
+			var err error
+			if kc, err = sd.LoadKubeconfig(cfg.ServiceDiscoveryK8sKubeconfig); err != nil {
+				return nil, err
+			}
+		}
+
+		return &sd.KubernetesServiceDiscovery{
+			Service:   cfg.ServiceDiscoveryK8sService,
+			Namespace: cfg.ServiceDiscoveryK8sNamespace,
+			Config:    kc,
+			Logger:    logger,
+		}, nil
+
+	case "static":
+		peers, err := sd.ParsePeers(splitList(cfg.ServiceDiscoveryStaticPeers))
+		if err != nil {
+			return nil, err
+		}
+
+		return &sd.StaticServiceDiscovery{Peers: peers, Logger: logger}, nil
+
+	case "file":
+		return &sd.FileServiceDiscovery{Filename: cfg.ServiceDiscoveryFile, Logger: logger}, nil
+
+	case "gossip":
+		return &sd.GossipServiceDiscovery{
+			BindAddress:      cfg.ServiceDiscoveryGossipBind,
+			AdvertiseAddress: cfg.ServiceDiscoveryGossipAdvertise,
+			Seeds:            splitList(cfg.ServiceDiscoveryGossipSeeds),
+			Port:             cfg.Port,
+			Logger:           logger,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown service discovery method %q", cfg.ServiceDiscoveryMethod)
+}
+
+func splitList(s string) (items []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return
+}
+
+// advertiseAddress returns the host:port this node is known by to its peers.
+func advertiseAddress() (string, error) {
+	if cfg.AdvertiseAddress != "" {
+		peer, err := sd.ParsePeer(cfg.AdvertiseAddress)
+		if err != nil {
+			return "", err
+		}
+
+		return peer.Address(cfg.Port), nil
+	}
+
+	if cfg.ServiceDiscoveryMethod == "gossip" && cfg.ServiceDiscoveryGossipAdvertise != "" {
+		host, _, err := net.SplitHostPort(cfg.ServiceDiscoveryGossipAdvertise)
+		if err != nil {
+			return "", err
+		}
+
+		return net.JoinHostPort(host, strconv.Itoa(cfg.Port)), nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			return net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(cfg.Port)), nil
+		}
+	}
+
+	return "", fmt.Errorf("no global unicast address found, set the advertise address")
+}
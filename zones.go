@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/conf"
+)
+
+// zoneFlags holds the --zone flags, each one a comma-separated list of
+// key=value settings (name, dir, levels, replication, factor, namespace).
+type zoneFlags []map[string]string
+
+func (z *zoneFlags) String() string { return fmt.Sprint(*z) }
+
+func (z *zoneFlags) Set(s string) error {
+	settings := make(map[string]string)
+	for _, item := range splitList(s) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid zone setting %q, expected key=value", item)
+		}
+
+		switch key {
+		case "name", "dir", "levels", "replication", "factor", "namespace":
+		default:
+			return fmt.Errorf("unknown zone setting %q", key)
+		}
+
+		settings[key] = value
+	}
+
+	if settings["name"] == "" {
+		return fmt.Errorf("zone name is required")
+	}
+
+	*z = append(*z, settings)
+
+	return nil
+}
+
+// newZones builds the cache zones from, in order: the Nginx configuration (or
+// the --cache-dir and --cache-levels flags), then the --zone flags.
+func newZones(logger *zap.Logger) ([]*nginx.Zone, error) {
+	var zones []*nginx.Zone
+
+	newZone := func(name, dir string, levels []int) *nginx.Zone {
+		z := &nginx.Zone{
+			Name:              name,
+			Namespace:         name,
+			Watcher:           &cr.CacheWatcher{Directory: dir, TombstoneTTL: cfg.TombstoneTTL, Logger: logger.With(zap.String("zone", name))},
+			Levels:            levels,
+			Replication:       nginx.ReplicateOwned,
+			ReplicationFactor: cfg.ReplicationFactor,
+		}
+
+		if cfg.ReplicationFactor <= 0 {
+			z.Replication = nginx.ReplicateAll
+		}
+
+		zones = append(zones, z)
+
+		return z
+	}
+
+	levels, err := cr.ParseLevels(cfg.CacheLevels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache levels %q: %w", cfg.CacheLevels, err)
+	}
+
+	if cfg.NginxConfig != "" {
+		found, err := cacheZones()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the cache zones from %s: %w", cfg.NginxConfig, err)
+		}
+
+		for _, zone := range found {
+			logger.Info("Found cache zone in Nginx configuration", zap.String("zone", zone.Name), zap.String("path", zone.Path), zap.Ints("levels", zone.Levels), zap.Strings("keys", zone.Keys))
+			newZone(zone.Name, zone.Path, zone.Levels)
+		}
+
+		if len(zones) == 1 {
+			if cfg.CacheLevels != "" && !reflect.DeepEqual(levels, zones[0].Levels) {
+				return nil, fmt.Errorf("cache levels %q do not match the Nginx configuration (%v)", cfg.CacheLevels, zones[0].Levels)
+			}
+
+			if cfg.CacheDir != "" { // the sidecar may mount the cache somewhere else
+				zones[0].Watcher.Directory = cfg.CacheDir
+			}
+		} else if cfg.CacheDir != "" || cfg.CacheLevels != "" {
+			return nil, fmt.Errorf("cache dir and levels only apply to a single zone, set them with --zone instead")
+		}
+	} else if cfg.CacheDir != "" || len(cfg.Zones) == 0 {
+		newZone("default", cfg.CacheDir, levels)
+	}
+
+	for _, settings := range cfg.Zones {
+		var z *nginx.Zone
+		for _, zone := range zones {
+			if zone.Name == settings["name"] {
+				z = zone
+			}
+		}
+
+		if z == nil {
+			if settings["dir"] == "" {
+				return nil, fmt.Errorf("zone %q: dir is required", settings["name"])
+			}
+
+			z = newZone(settings["name"], "", nil)
+		}
+
+		if err := applyZoneSettings(z, settings); err != nil {
+			return nil, fmt.Errorf("zone %q: %w", z.Name, err)
+		}
+	}
+
+	// peers tell zones apart by namespace only
+	names := make(map[string]string) // by namespace
+	for _, z := range zones {
+		if name, found := names[z.Namespace]; found {
+			return nil, fmt.Errorf("zones %q and %q share the namespace %q", name, z.Name, z.Namespace)
+		}
+
+		names[z.Namespace] = z.Name
+	}
+
+	return zones, nil
+}
+
+func applyZoneSettings(z *nginx.Zone, settings map[string]string) (err error) {
+	for key, value := range settings {
+		switch key {
+		case "dir":
+			z.Watcher.Directory = value
+
+		case "levels":
+			z.Levels, err = cr.ParseLevels(value)
+
+		case "replication":
+			z.Replication, err = nginx.ParseReplicationPolicy(value)
+
+		case "factor":
+			z.ReplicationFactor, err = strconv.Atoi(value)
+
+		case "namespace":
+			z.Namespace = value
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", key, value, err)
+		}
+	}
+
+	return nil
+}
+
+// cacheZones returns the cache zones to share from the Nginx configuration:
+// the ones listed in --cache-zone, or all of them.
+func cacheZones() ([]*conf.CacheZone, error) {
+	directives, err := conf.Parse(cfg.NginxConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := conf.CacheZones(directives)
+	if err != nil {
+		return nil, err
+	}
+
+	names := splitList(cfg.CacheZone)
+	if len(names) == 0 {
+		for name := range zones {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	var selected []*conf.CacheZone
+	for _, name := range names {
+		zone, found := zones[name]
+		if !found {
+			return nil, fmt.Errorf("cache zone %q not found", name)
+		}
+
+		selected = append(selected, zone)
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/nettoclaudio/nginx-p2p-cache/internal/nginx"
+	cr "github.com/nettoclaudio/nginx-p2p-cache/internal/nginx/cache_repository"
+)
+
+const testNginxConfig = `
+http {
+    proxy_cache_path /var/cache/nginx/api levels=1:2 keys_zone=api:10m;
+    proxy_cache_path /var/cache/nginx/static keys_zone=static:64m;
+}
+`
+
+// setConfig replaces the flags for the rest of the test.
+func setConfig(t *testing.T, set func()) {
+	t.Helper()
+
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+
+	set()
+}
+
+func writeNginxConfig(t *testing.T) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "nginx.conf")
+	require.NoError(t, os.WriteFile(filename, []byte(testNginxConfig), 0o600))
+
+	return filename
+}
+
+func TestNewZones(t *testing.T) {
+	type zone struct {
+		name, namespace, dir string
+		levels               []int
+		replication          nginx.ReplicationPolicy
+		factor               int
+	}
+
+	nginxConfig := writeNginxConfig(t)
+
+	for _, tt := range []struct {
+		name    string
+		set     func()
+		zones   []zone
+		wantErr string
+	}{
+		{
+			name:  "cache dir",
+			set:   func() { cfg.CacheDir, cfg.CacheLevels, cfg.ReplicationFactor = "/var/cache/nginx", "1:2", 2 },
+			zones: []zone{{name: "default", namespace: "default", dir: "/var/cache/nginx", levels: []int{1, 2}, replication: nginx.ReplicateOwned, factor: 2}},
+		},
+		{
+			name:  "replicating everything",
+			set:   func() { cfg.CacheDir, cfg.ReplicationFactor = "/var/cache/nginx", 0 },
+			zones: []zone{{name: "default", namespace: "default", dir: "/var/cache/nginx", replication: nginx.ReplicateAll}},
+		},
+		{
+			name: "nginx configuration",
+			set:  func() { cfg.NginxConfig, cfg.ReplicationFactor = nginxConfig, 2 },
+			zones: []zone{
+				{name: "api", namespace: "api", dir: "/var/cache/nginx/api", levels: []int{1, 2}, replication: nginx.ReplicateOwned, factor: 2},
+				{name: "static", namespace: "static", dir: "/var/cache/nginx/static", replication: nginx.ReplicateOwned, factor: 2},
+			},
+		},
+		{
+			name: "single zone mounted elsewhere",
+			set: func() {
+				cfg.NginxConfig, cfg.CacheZone, cfg.CacheDir, cfg.ReplicationFactor = nginxConfig, "api", "/mnt/api", 2
+			},
+			zones: []zone{
+				{name: "api", namespace: "api", dir: "/mnt/api", levels: []int{1, 2}, replication: nginx.ReplicateOwned, factor: 2},
+			},
+		},
+		{
+			name: "zone flags",
+			set: func() {
+				cfg.NginxConfig, cfg.ReplicationFactor = nginxConfig, 2
+				cfg.Zones = zoneFlags{
+					{"name": "static", "replication": "all", "namespace": "assets"},
+					{"name": "images", "dir": "/var/cache/images", "levels": "2", "factor": "3"},
+				}
+			},
+			zones: []zone{
+				{name: "api", namespace: "api", dir: "/var/cache/nginx/api", levels: []int{1, 2}, replication: nginx.ReplicateOwned, factor: 2},
+				{name: "static", namespace: "assets", dir: "/var/cache/nginx/static", replication: nginx.ReplicateAll, factor: 2},
+				{name: "images", namespace: "images", dir: "/var/cache/images", levels: []int{2}, replication: nginx.ReplicateOwned, factor: 3},
+			},
+		},
+		{
+			name:    "duplicate namespace",
+			set:     func() { cfg.NginxConfig, cfg.Zones = nginxConfig, zoneFlags{{"name": "static", "namespace": "api"}} },
+			wantErr: `zones "api" and "static" share the namespace "api"`,
+		},
+		{
+			name: "duplicate namespace of a new zone",
+			set: func() {
+				cfg.CacheDir, cfg.Zones = "/var/cache/nginx", zoneFlags{{"name": "other", "dir": "/tmp", "namespace": "default"}}
+			},
+			wantErr: `zones "default" and "other" share the namespace "default"`,
+		},
+		{
+			name:    "new zone without dir",
+			set:     func() { cfg.Zones = zoneFlags{{"name": "images"}} },
+			wantErr: `zone "images": dir is required`,
+		},
+		{
+			name:    "dir with several zones",
+			set:     func() { cfg.NginxConfig, cfg.CacheDir = nginxConfig, "/mnt" },
+			wantErr: "only apply to a single zone",
+		},
+		{
+			name:    "levels not matching",
+			set:     func() { cfg.NginxConfig, cfg.CacheZone, cfg.CacheLevels = nginxConfig, "api", "2" },
+			wantErr: "do not match the Nginx configuration",
+		},
+		{
+			name:    "invalid levels",
+			set:     func() { cfg.CacheLevels = "3" },
+			wantErr: "invalid cache levels",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, tt.set)
+
+			zones, err := newZones(zap.NewNop())
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+
+			var got []zone
+			for _, z := range zones {
+				got = append(got, zone{name: z.Name, namespace: z.Namespace, dir: z.Watcher.Directory, levels: z.Levels, replication: z.Replication, factor: z.ReplicationFactor})
+			}
+
+			assert.Equal(t, tt.zones, got)
+		})
+	}
+}
+
+func TestApplyZoneSettings(t *testing.T) {
+	for _, tt := range []struct {
+		settings map[string]string
+		expected nginx.Zone
+		wantErr  string
+	}{
+		{
+			settings: map[string]string{"name": "api", "dir": "/mnt/api", "levels": "1:2", "replication": "none", "factor": "3", "namespace": "v2"},
+			expected: nginx.Zone{Name: "api", Namespace: "v2", Levels: []int{1, 2}, Replication: nginx.ReplicateNone, ReplicationFactor: 3},
+		},
+		{
+			settings: map[string]string{"name": "api"},
+			expected: nginx.Zone{Name: "api", Namespace: "api", Replication: nginx.ReplicateOwned, ReplicationFactor: 2},
+		},
+		{settings: map[string]string{"levels": "1:2:3:4"}, wantErr: "invalid levels"},
+		{settings: map[string]string{"replication": "some"}, wantErr: "invalid replication"},
+		{settings: map[string]string{"factor": "two"}, wantErr: "invalid factor"},
+	} {
+		z := &nginx.Zone{Name: "api", Namespace: "api", Watcher: &cr.CacheWatcher{}, Replication: nginx.ReplicateOwned, ReplicationFactor: 2}
+
+		err := applyZoneSettings(z, tt.settings)
+		if tt.wantErr != "" {
+			assert.ErrorContains(t, err, tt.wantErr, tt.settings)
+			continue
+		}
+
+		require.NoError(t, err, tt.settings)
+
+		if dir, found := tt.settings["dir"]; found {
+			assert.Equal(t, dir, z.Watcher.Directory)
+		}
+
+		z.Watcher = nil
+		assert.Equal(t, &tt.expected, z, tt.settings)
+	}
+}
+
+func TestCacheZones(t *testing.T) {
+	nginxConfig := writeNginxConfig(t)
+
+	for _, tt := range []struct {
+		cacheZone string
+		expected  []string
+		wantErr   string
+	}{
+		{expected: []string{"api", "static"}},
+		{cacheZone: "static", expected: []string{"static"}},
+		{cacheZone: "static, api", expected: []string{"static", "api"}},
+		{cacheZone: "images", wantErr: `cache zone "images" not found`},
+	} {
+		setConfig(t, func() { cfg.NginxConfig, cfg.CacheZone = nginxConfig, tt.cacheZone })
+
+		zones, err := cacheZones()
+		if tt.wantErr != "" {
+			assert.ErrorContains(t, err, tt.wantErr, tt.cacheZone)
+			continue
+		}
+
+		require.NoError(t, err, tt.cacheZone)
+
+		var names []string
+		for _, z := range zones {
+			names = append(names, z.Name)
+		}
+
+		assert.Equal(t, tt.expected, names, tt.cacheZone)
+	}
+
+	setConfig(t, func() { cfg.NginxConfig = filepath.Join(t.TempDir(), "missing.conf") })
+
+	_, err := cacheZones()
+	assert.Error(t, err)
+}